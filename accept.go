@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Bobochka/thumbnail_service/lib/transform"
+)
+
+type negotiable struct {
+	mime   string
+	format string
+}
+
+// negotiableFormats lists output formats in server preference order,
+// which is used to break ties between equally acceptable formats.
+// Lossless webp is bigger than jpeg, so it is picked only if client prefers it.
+// Formats we can't encode (e.g. avif) are never negotiated.
+var negotiableFormats = []negotiable{
+	{"image/jpeg", transform.FormatJpeg},
+	{"image/webp", transform.FormatWebp},
+	{"image/png", transform.FormatPng},
+	{"image/gif", transform.FormatGif},
+}
+
+// alphaFormats replace jpeg when transparency has to be kept,
+// lossless webp is smaller than png, so it goes first.
+var alphaFormats = []negotiable{
+	{"image/webp", transform.FormatWebp},
+	{"image/png", transform.FormatPng},
+}
+
+// negotiateFormat picks output format most preferred by the Accept header, jpeg if none of the formats is acceptable,
+// as well as format to use instead of jpeg for transparent images, png if neither is acceptable.
+// Among equally preferred formats server preference wins, so that `image/webp,*/*` results in jpeg.
+func negotiateFormat(accept string) (format, alphaFormat string) {
+	ranges := parseAccept(accept)
+
+	return preferredFormat(ranges, negotiableFormats, transform.FormatJpeg),
+		preferredFormat(ranges, alphaFormats, transform.FormatPng)
+}
+
+func preferredFormat(ranges []mediaRange, formats []negotiable, fallback string) string {
+	best, bestQ := fallback, 0.0
+
+	for _, f := range formats {
+		if q, _ := acceptQuality(ranges, f.mime); q > bestQ {
+			best, bestQ = f.format, q
+		}
+	}
+
+	return best
+}
+
+type mediaRange struct {
+	mime string
+	q    float64
+}
+
+func parseAccept(accept string) []mediaRange {
+	var res []mediaRange
+
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+
+		r := mediaRange{mime: strings.ToLower(strings.TrimSpace(fields[0])), q: 1}
+		if r.mime == "" {
+			continue
+		}
+
+		for _, param := range fields[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) != 2 || kv[0] != "q" {
+				continue
+			}
+
+			q, err := strconv.ParseFloat(kv[1], 64)
+			if err == nil {
+				r.q = q
+			}
+		}
+
+		res = append(res, r)
+	}
+
+	return res
+}
+
+// acceptQuality returns quality and specificity of the most specific range matching mime:
+// 2 for exact match, 1 for type wildcard, 0 for */*, -1 if there's no match
+func acceptQuality(ranges []mediaRange, mime string) (float64, int) {
+	typ := strings.SplitN(mime, "/", 2)[0]
+
+	q, specificity := 0.0, -1
+	for _, r := range ranges {
+		s := -1
+		switch r.mime {
+		case mime:
+			s = 2
+		case typ + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		}
+
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+
+	return q, specificity
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"net/url"
 
@@ -11,19 +14,39 @@ import (
 
 	"log"
 
+	"image/color"
+
 	"github.com/Bobochka/thumbnail_service/lib"
+	"github.com/Bobochka/thumbnail_service/lib/metrics"
 	"github.com/Bobochka/thumbnail_service/lib/service"
+	"github.com/Bobochka/thumbnail_service/lib/signature"
 	"github.com/Bobochka/thumbnail_service/lib/transform"
 )
 
 type App struct {
-	service *service.Service
+	service        *service.Service
+	defaultQuality int
+	maxQuality     int
+	cacheMaxAge    int // seconds
+	// secret to verify request signatures with, signatures are not required if empty
+	secret []byte
+	limits transform.Limits
+	// deadline of the whole request, none if zero
+	requestTimeout time.Duration
 }
 
 type params struct {
-	url    string
-	width  int
-	height int
+	url     string
+	width   int
+	height  int
+	mode    string
+	bg      color.NRGBA
+	format  string
+	quality int
+	// negotiated is set when format was picked from Accept header
+	negotiated bool
+	// alphaFormat replaces jpeg when transparency has to be kept
+	alphaFormat string
 }
 
 func (app *App) thumbnail(w http.ResponseWriter, r *http.Request) {
@@ -33,26 +56,83 @@ func (app *App) thumbnail(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
+	if err := app.verifySignature(r); err != nil {
+		app.renderError(w, err)
+		return
+	}
+
 	params, err := app.thumbnailParams(r)
 	if err != nil {
 		app.renderError(w, err)
 		return
 	}
 
-	t := transform.NewLPad(params.width, params.height)
+	if params.negotiated {
+		w.Header().Set("Vary", "Accept")
+	}
+
+	t := app.transformation(params)
+
+	// work is abandoned once client disconnects
+	ctx := r.Context()
+	if app.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, app.requestTimeout)
+		defer cancel()
+	}
 
-	img, err := app.service.Perform(params.url, t)
+	img, key, err := app.service.Perform(ctx, params.url, t, etagMatcher(r.Header.Get("If-None-Match")))
+
+	if err == service.ErrNotModified {
+		app.renderNotModified(w, key)
+		return
+	}
+
+	switch err {
+	case context.DeadlineExceeded:
+		err = lib.NewError(err, lib.RequestTimeout)
+	case context.Canceled:
+		err = lib.NewError(err, lib.RequestCancelled)
+	}
 
 	if err != nil {
 		app.renderError(w, err)
 		return
 	}
 
-	app.renderImg(w, img)
+	app.renderImg(w, img, key)
+}
+
+func (app *App) verifySignature(r *http.Request) error {
+	if len(app.secret) == 0 {
+		return nil
+	}
+
+	err := signature.Verify(app.secret, r.URL.Query(), time.Now())
+	if err != nil {
+		return lib.NewError(err, lib.InvalidSignature)
+	}
+
+	return nil
+}
+
+func (app *App) transformation(p params) service.Transformation {
+	codec := transform.Img{Format: p.format, AlphaFormat: p.alphaFormat, Quality: p.quality, Limits: app.limits}
+
+	if p.mode == modeFill {
+		return transform.NewFill(p.width, p.height, codec)
+	}
+
+	return transform.NewLPad(p.width, p.height, p.bg, codec)
 }
 
 const maxAllowedArea = 6000000 // px
 
+const (
+	modePad  = "pad"
+	modeFill = "fill"
+)
+
 func (app *App) thumbnailParams(r *http.Request) (params, error) {
 	var res params
 
@@ -82,13 +162,102 @@ func (app *App) thumbnailParams(r *http.Request) (params, error) {
 		return params{}, lib.NewError(err, lib.InvalidParams, err.Error())
 	}
 
+	res.mode = r.URL.Query().Get("mode")
+	if res.mode == "" {
+		res.mode = modePad
+	}
+
+	if res.mode != modePad && res.mode != modeFill {
+		err = fmt.Errorf("mode %s is not valid: should be one of %s, %s", res.mode, modePad, modeFill)
+		return params{}, lib.NewError(err, lib.InvalidParams, err.Error())
+	}
+
+	res.bg = transform.Black
+	if bg := r.URL.Query().Get("bg"); bg != "" {
+		res.bg, err = transform.ParseColor(bg)
+		if err != nil {
+			err = fmt.Errorf("bg %s is not valid: should be hex color in RRGGBB or RRGGBBAA notation", bg)
+			return params{}, lib.NewError(err, lib.InvalidParams, err.Error())
+		}
+	}
+
+	res.format = r.URL.Query().Get("format")
+	if res.format == "" {
+		res.format, res.alphaFormat = negotiateFormat(r.Header.Get("Accept"))
+		res.negotiated = true
+	}
+
+	if !isOneOf(res.format, transform.Formats) {
+		err = fmt.Errorf("format %s is not valid: should be one of %s", res.format, strings.Join(transform.Formats, ", "))
+		return params{}, lib.NewError(err, lib.InvalidParams, err.Error())
+	}
+
+	res.quality = app.defaultQuality
+	if q := r.URL.Query().Get("quality"); q != "" {
+		res.quality, err = strconv.Atoi(q)
+		if err != nil || res.quality < 1 || res.quality > transform.MaxQuality {
+			err = fmt.Errorf("quality %s is not valid: should be integer between 1 and %d", q, transform.MaxQuality)
+			return params{}, lib.NewError(err, lib.InvalidParams, err.Error())
+		}
+	}
+
+	if app.maxQuality > 0 && res.quality > app.maxQuality {
+		res.quality = app.maxQuality
+	}
+
 	return res, nil
 }
 
-func (app *App) renderImg(w http.ResponseWriter, img []byte) {
-	w.Header().Set("Content-Type", "image/jpeg")
+func isOneOf(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (app *App) renderImg(w http.ResponseWriter, img []byte, key string) {
+	app.setCacheHeaders(w, key)
+	w.Header().Set("Content-Type", http.DetectContentType(img))
 	w.Header().Set("Content-Length", strconv.Itoa(len(img)))
 	w.Write(img)
+
+	metrics.Bytes.WithLabelValues("out").Add(float64(len(img)))
+}
+
+func (app *App) renderNotModified(w http.ResponseWriter, key string) {
+	app.setCacheHeaders(w, key)
+	w.WriteHeader(http.StatusNotModified)
+}
+
+func (app *App) setCacheHeaders(w http.ResponseWriter, key string) {
+	w.Header().Set("ETag", etag(key))
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", app.cacheMaxAge))
+}
+
+func etag(key string) string {
+	return `"` + key + `"`
+}
+
+// etagMatcher returns func reporting whether key is listed in If-None-Match header value
+func etagMatcher(ifNoneMatch string) func(key string) bool {
+	if ifNoneMatch == "" {
+		return nil
+	}
+
+	return func(key string) bool {
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimSpace(tag)
+			// weak comparison, as required for If-None-Match
+			tag = strings.TrimPrefix(tag, "W/")
+
+			if tag == "*" || tag == etag(key) {
+				return true
+			}
+		}
+		return false
+	}
 }
 
 func (app *App) renderError(w http.ResponseWriter, err error) {
@@ -105,17 +274,20 @@ func (app *App) renderError(w http.ResponseWriter, err error) {
 	}
 
 	log.Println("error: ", realMsg)
-
-	w.WriteHeader(code)
+	recordError(w, err)
 
 	response := struct{ Error string }{msg}
 	data, e := json.Marshal(response)
 
+	w.Header().Set("Cache-Control", "no-store")
+
 	if e != nil {
 		log.Println("error marshaling response: ", e.Error())
+		w.WriteHeader(code)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
 	w.Write(data)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -13,7 +14,16 @@ import (
 
 	"io/ioutil"
 
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Bobochka/thumbnail_service/lib/downloader"
+	"github.com/Bobochka/thumbnail_service/lib/locker"
+	"github.com/Bobochka/thumbnail_service/lib/metrics"
 	"github.com/Bobochka/thumbnail_service/lib/service"
+	"github.com/Bobochka/thumbnail_service/lib/signature"
+	"github.com/Bobochka/thumbnail_service/lib/store"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
@@ -28,11 +38,24 @@ var _ = Describe("App", func() {
 	var app *App
 
 	BeforeSuite(func() {
-		cfg, err := ReadConfig()
+		cfg, _, err := ReadConfig()
 
 		Expect(err).NotTo(HaveOccurred())
 
-		app = &App{service: service.New(cfg)}
+		gock.InterceptClient(cfg.Downloader.(*downloader.Http).Client())
+		// specs expect source to be downloaded on every request
+		cfg.Index = nil
+		cfg.Failures = nil
+
+		app = &App{
+			service:        service.New(cfg),
+			defaultQuality: jpegQuality(),
+			maxQuality:     maxJpegQuality(),
+			cacheMaxAge:    cacheMaxAge(),
+			secret:         signatureSecret(),
+			limits:         sourceLimits(),
+			requestTimeout: requestTimeout(),
+		}
 	})
 
 	Describe("/thumbnail", func() {
@@ -61,10 +84,97 @@ var _ = Describe("App", func() {
 			Entry("too big", "http://google.com", "42000", "42000", "requested size of 42000 x 42000 is too big"),
 		)
 
+		It("Rejects invalid bg", func() {
+			rr, err := Request(app, "?url=http://google.com&width=42&height=42&bg=white")
+			Expect(err).NotTo(HaveOccurred())
+
+			resp := struct{ Error string }{}
+
+			err = json.Unmarshal(rr.Body.Bytes(), &resp)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(resp.Error).To(Equal("bg white is not valid: should be hex color in RRGGBB or RRGGBBAA notation"))
+			Expect(rr.Code).To(Equal(400))
+		})
+
+		It("Rejects unknown format", func() {
+			rr, err := Request(app, "?url=http://google.com&width=42&height=42&format=bmp")
+			Expect(err).NotTo(HaveOccurred())
+
+			resp := struct{ Error string }{}
+
+			err = json.Unmarshal(rr.Body.Bytes(), &resp)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(resp.Error).To(Equal("format bmp is not valid: should be one of jpeg, png, gif, webp, auto"))
+			Expect(rr.Code).To(Equal(400))
+		})
+
+		It("Rejects invalid quality", func() {
+			rr, err := Request(app, "?url=http://google.com&width=42&height=42&quality=101")
+			Expect(err).NotTo(HaveOccurred())
+
+			resp := struct{ Error string }{}
+
+			err = json.Unmarshal(rr.Body.Bytes(), &resp)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(resp.Error).To(Equal("quality 101 is not valid: should be integer between 1 and 100"))
+			Expect(rr.Code).To(Equal(400))
+		})
+
+		Context("When signatures are required", func() {
+			BeforeEach(func() {
+				app.secret = []byte("secret")
+			})
+
+			AfterEach(func() {
+				app.secret = signatureSecret()
+			})
+
+			It("Rejects unsigned request", func() {
+				rr, err := Request(app, "?url=http://google.com&width=42&height=42")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(rr.Code).To(Equal(403))
+			})
+
+			It("Accepts signed request", func() {
+				signed, err := signature.SignURL(app.secret, "/thumbnail", url.Values{
+					"url":    {"malformed.com"},
+					"width":  {"42"},
+					"height": {"42"},
+				}, time.Now().Add(time.Minute))
+				Expect(err).NotTo(HaveOccurred())
+
+				rr, err := Request(app, strings.TrimPrefix(signed, "/thumbnail"))
+				Expect(err).NotTo(HaveOccurred())
+
+				// passes signature check and fails on url validation
+				Expect(rr.Code).To(Equal(400))
+			})
+		})
+
+		It("Rejects unknown mode", func() {
+			rr, err := Request(app, "?url=http://google.com&width=42&height=42&mode=stretch")
+			Expect(err).NotTo(HaveOccurred())
+
+			resp := struct{ Error string }{}
+
+			err = json.Unmarshal(rr.Body.Bytes(), &resp)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(resp.Error).To(Equal("mode stretch is not valid: should be one of pad, fill"))
+			Expect(rr.Code).To(Equal(400))
+		})
+
 		Context("Presumably Valid params", func() {
 			var rr *httptest.ResponseRecorder
+			var header http.Header
+			var ctx context.Context
 
 			BeforeEach(func() {
+				header = http.Header{}
+				ctx = context.Background()
 				gock.EnableNetworking() // in order to access s3
 			})
 
@@ -76,7 +186,7 @@ var _ = Describe("App", func() {
 				query := "?url=http://foo.com/sample.jpg&width=200&height=200"
 
 				var err error
-				rr, err = Request(app, query)
+				rr, err = RequestWithContext(ctx, app, query, header)
 				Expect(err).NotTo(HaveOccurred())
 			})
 
@@ -99,6 +209,75 @@ var _ = Describe("App", func() {
 					Expect(rr.Code).To(Equal(200))
 					Expect(rr.Body.Bytes()).To(Equal(data))
 				})
+
+				It("Renders caching headers", func() {
+					Expect(rr.Header().Get("ETag")).NotTo(BeEmpty())
+					Expect(rr.Header().Get("Cache-Control")).To(Equal(fmt.Sprintf("public, max-age=%d", app.cacheMaxAge)))
+				})
+
+				Context("When client already has the thumbnail", func() {
+					var etag string
+
+					BeforeEach(func() {
+						rr, err := Request(app, "?url=http://foo.com/sample.jpg&width=200&height=200")
+						Expect(err).NotTo(HaveOccurred())
+
+						etag = rr.Header().Get("ETag")
+						header.Set("If-None-Match", etag)
+
+						gock.New("http://foo.com").
+							Get("/sample.jpg").
+							Reply(200).
+							File("./testdata/sample.jpg")
+					})
+
+					It("Renders not modified", func() {
+						Expect(rr.Code).To(Equal(304))
+						Expect(rr.Body.Bytes()).To(BeEmpty())
+						Expect(rr.Header().Get("ETag")).To(Equal(etag))
+					})
+				})
+			})
+
+			Context("When processing takes too long", func() {
+				var timeout time.Duration
+
+				BeforeEach(func() {
+					timeout = app.requestTimeout
+					app.requestTimeout = 20 * time.Millisecond
+
+					gock.New("http://foo.com").
+						Get("/sample.jpg").
+						Reply(200).
+						Delay(50 * time.Millisecond).
+						File("./testdata/sample.jpg")
+				})
+
+				AfterEach(func() {
+					app.requestTimeout = timeout
+				})
+
+				It("Responds with timeout", func() {
+					resp := struct{ Error string }{}
+
+					err := json.Unmarshal(rr.Body.Bytes(), &resp)
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(resp.Error).To(Equal("Timed out processing the request, please, try again later"))
+					Expect(rr.Code).To(Equal(504))
+				})
+			})
+
+			Context("When client disconnects", func() {
+				BeforeEach(func() {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithCancel(ctx)
+					cancel()
+				})
+
+				It("Responds with client closed request", func() {
+					Expect(rr.Code).To(Equal(499))
+				})
 			})
 
 			Context("When actually not an image", func() {
@@ -121,18 +300,94 @@ var _ = Describe("App", func() {
 
 					Expect(resp.Error).To(Equal("Content type is not supported, supported formats: jpeg, gif, png"))
 					Expect(rr.Code).To(Equal(400))
+					Expect(rr.Header().Get("Cache-Control")).To(Equal("no-store"))
 				})
 			})
 		})
 	})
 })
 
+var _ = Describe("Redis keys", func() {
+	It("Keeps thumbnails apart from locks on them", func() {
+		pool, err := locker.NewPool(redisURL())
+		Expect(err).NotTo(HaveOccurred())
+		defer pool.Close()
+
+		ctx := context.Background()
+		s := store.NewRedis(pool, redisStorePrefix(), time.Minute, 0)
+		key := fmt.Sprintf("redis_keys_spec_%d", time.Now().UnixNano())
+
+		m := locker.New(pool, lockKeyPrefix).NewMutex(key)
+		Expect(m.Lock(ctx)).To(Succeed())
+		defer m.Unlock()
+
+		_, found, err := s.Get(ctx, key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeFalse())
+
+		Expect(s.Set(ctx, key, []byte("thumbnail"))).To(Succeed())
+		Expect(m.Extend()).To(BeTrue())
+	})
+})
+
+var _ = Describe("instrumented", func() {
+	It("Counts requests by status and error type", func() {
+		handler := instrumented((&App{}).thumbnail)
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/thumbnail?url=foo", nil))
+		Expect(rr.Code).To(Equal(400))
+
+		scrape := httptest.NewRecorder()
+		metrics.Handler().ServeHTTP(scrape, httptest.NewRequest("GET", "/metrics", nil))
+
+		Expect(scrape.Body.String()).To(ContainSubstring(`thumbnail_requests_total{error="invalid_params",status="400"} 1`))
+		Expect(scrape.Body.String()).To(ContainSubstring(`thumbnail_in_flight_requests 0`))
+	})
+
+	It("Exports memory cache stats", func() {
+		metrics.MemoryCache(func() (uint64, uint64, int64) { return 3, 4, 5 })
+
+		scrape := httptest.NewRecorder()
+		metrics.Handler().ServeHTTP(scrape, httptest.NewRequest("GET", "/metrics", nil))
+
+		Expect(scrape.Body.String()).To(ContainSubstring("thumbnail_memory_cache_hits_total 3"))
+		Expect(scrape.Body.String()).To(ContainSubstring("thumbnail_memory_cache_misses_total 4"))
+		Expect(scrape.Body.String()).To(ContainSubstring("thumbnail_memory_cache_bytes 5"))
+	})
+})
+
+var _ = DescribeTable("negotiateFormat",
+	func(accept, format, alphaFormat string) {
+		f, af := negotiateFormat(accept)
+		Expect(f).To(Equal(format))
+		Expect(af).To(Equal(alphaFormat))
+	},
+	Entry("no header", "", "jpeg", "png"),
+	Entry("anything", "*/*", "jpeg", "webp"),
+	Entry("browser with webp", "image/avif,image/webp,image/apng,image/*,*/*;q=0.8", "jpeg", "webp"),
+	Entry("webp preferred", "image/webp,image/*;q=0.8", "webp", "webp"),
+	Entry("webp not preferred", "image/webp;q=0.5,image/*", "jpeg", "png"),
+	Entry("webp refused", "image/webp;q=0,*/*", "jpeg", "png"),
+	Entry("png only", "image/png", "png", "png"),
+	Entry("avif only", "image/avif", "jpeg", "png"),
+)
+
 func Request(app *App, query string) (*httptest.ResponseRecorder, error) {
+	return RequestWithContext(context.Background(), app, query, nil)
+}
+
+func RequestWithContext(ctx context.Context, app *App, query string, header http.Header) (*httptest.ResponseRecorder, error) {
 	req, err := http.NewRequest("GET", "/thumbnail"+query, nil)
 
 	if err != nil {
 		return nil, err
 	}
+	req = req.WithContext(ctx)
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
 
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(app.thumbnail)
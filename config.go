@@ -2,38 +2,270 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Bobochka/thumbnail_service/lib"
 	"github.com/Bobochka/thumbnail_service/lib/downloader"
+	"github.com/Bobochka/thumbnail_service/lib/failures"
+	"github.com/Bobochka/thumbnail_service/lib/index"
 	"github.com/Bobochka/thumbnail_service/lib/locker"
+	"github.com/Bobochka/thumbnail_service/lib/metrics"
+	"github.com/Bobochka/thumbnail_service/lib/notifier"
 	"github.com/Bobochka/thumbnail_service/lib/service"
 	"github.com/Bobochka/thumbnail_service/lib/store"
+	"github.com/Bobochka/thumbnail_service/lib/transform"
+	"github.com/garyburd/redigo/redis"
 )
 
 const (
-	defaultAwsRegion = "us-east-1"
-	defaultBucket    = "cldnrthumbnails"
-	defaultRedisURL  = "redis://localhost:6379"
-	defaultBindPort  = "8080"
+	defaultAwsRegion         = "us-east-1"
+	defaultBucket            = "cldnrthumbnails"
+	defaultRedisURL          = "redis://localhost:6379"
+	defaultBindPort          = "8080"
+	defaultQuality           = 100
+	defaultMaxQuality        = 100
+	defaultCacheMaxAge       = 24 * 60 * 60 // seconds
+	defaultRequestTimeout    = 60 * time.Second
+	defaultShutdownTimeout   = 30 * time.Second
+	defaultStoreBackend      = "s3"
+	defaultLockerBackend     = "redis"
+	defaultFSStorePath       = "./thumbnails"
+	defaultMemoryCache       = 64 << 20 // bytes
+	defaultRedisStoreMaxSize = 1 << 20  // bytes
+	defaultStoreErrorPolicy  = "bypass"
+	defaultBreakerThreshold  = 5
+	defaultBreakerCooldown   = 30 * time.Second
+	defaultIndexSize         = 100000 // entries
+	defaultIndexTTL          = 5 * time.Minute
+	defaultNegativeCacheSize = 10000 // entries
+	defaultNegativeCacheTTL  = 30 * time.Second
+	defaultRedisStorePrefix  = "thumbnail:"
+	notifierChannelPrefix    = "thumbnail_done:"
+	jobKeyPrefix             = "thumbnail_job:"
+	lockKeyPrefix            = "thumbnail_lock:"
 )
 
-func ReadConfig() (*service.Config, error) {
-	store, err := store.New(s3Endpoint(), awsRegion(), bucketName())
+// ReadConfig returns service config along with func closing connections it holds
+func ReadConfig() (*service.Config, func() error, error) {
+	var pool *redis.Pool
+
+	// redis is not required unless some component is backed by it
+	if lockerBackend() == "redis" || storeBackend() == "redis" {
+		var err error
+		pool, err = locker.NewPool(redisURL())
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to connect to redis: %s", err)
+		}
+	}
+
+	store, err := newStore(pool)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lock, notify, jobs, err := newCoordination(pool)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// notifier stops using the pool before it is closed
+	closeConfig := func() error {
+		if c, ok := notify.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				return err
+			}
+		}
+
+		if pool == nil {
+			return nil
+		}
+		return pool.Close()
+	}
+
+	policy, err := storeErrorPolicy()
 	if err != nil {
-		return nil, fmt.Errorf("unable to init s3 store: %s", err)
+		return nil, nil, err
 	}
 
-	locker, err := locker.New(redisURL())
+	opts, err := downloaderOptions()
 	if err != nil {
-		return nil, fmt.Errorf("unable to connect to redis: %s", err)
+		return nil, nil, err
 	}
 
 	return &service.Config{
 		Store:      store,
-		Downloader: downloader.New(lib.SupportedContentTypes),
-		Locker:     locker,
-	}, nil
+		Downloader: downloader.New(lib.SupportedContentTypes, opts...),
+		Locker:     lock,
+		Notifier:   notify,
+		Jobs:       jobs,
+		Index:      newIndex(),
+		IndexTTL:   durationEnv("INDEX_TTL", defaultIndexTTL),
+		Failures:   newFailures(),
+
+		StorePolicy:      policy,
+		BreakerThreshold: intEnv("STORE_BREAKER_THRESHOLD", defaultBreakerThreshold),
+		BreakerCooldown:  durationEnv("STORE_BREAKER_COOLDOWN", defaultBreakerCooldown),
+	}, closeConfig, nil
+}
+
+// newCoordination returns locker, notifier and job states, which have to share backend
+func newCoordination(pool *redis.Pool) (service.Locker, service.Notifier, service.Jobs, error) {
+	switch backend := lockerBackend(); backend {
+	case "redis":
+		return locker.New(pool, lockKeyPrefix), notifier.NewRedis(pool, notifierChannelPrefix), locker.NewRedisJobs(pool, jobKeyPrefix), nil
+	case "memory":
+		return locker.NewMemory(), notifier.NewMemory(), locker.NewMemoryJobs(), nil
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown locker backend %s", backend)
+	}
+}
+
+func newStore(pool *redis.Pool) (service.Store, error) {
+	s, err := newPersistentStore(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	if size := intEnv("MEMORY_CACHE_SIZE", defaultMemoryCache); size > 0 {
+		m := store.NewMemory(s, int64(size))
+		metrics.MemoryCache(m.Stats)
+		return m, nil
+	}
+
+	return s, nil
+}
+
+func newPersistentStore(pool *redis.Pool) (service.Store, error) {
+	switch backend := storeBackend(); backend {
+	case "s3":
+		s, err := store.New(s3Endpoint(), awsRegion(), bucketName())
+		if err != nil {
+			return nil, fmt.Errorf("unable to init s3 store: %s", err)
+		}
+		return s, nil
+	case "fs":
+		s, err := store.NewFS(fsStorePath(), int64(intEnv("FS_STORE_MAX_SIZE", 0)))
+		if err != nil {
+			return nil, fmt.Errorf("unable to init fs store: %s", err)
+		}
+		return s, nil
+	case "redis":
+		return store.NewRedis(
+			pool,
+			redisStorePrefix(),
+			durationEnv("REDIS_STORE_TTL", 0),
+			intEnv("REDIS_STORE_MAX_SIZE", defaultRedisStoreMaxSize),
+		), nil
+	default:
+		return nil, fmt.Errorf("unknown store backend %s", backend)
+	}
+}
+
+func newIndex() service.Index {
+	size := intEnv("INDEX_SIZE", defaultIndexSize)
+	if size <= 0 {
+		return nil
+	}
+
+	return index.NewMemory(size)
+}
+
+func newFailures() service.Failures {
+	size := intEnv("NEGATIVE_CACHE_SIZE", defaultNegativeCacheSize)
+	ttl := durationEnv("NEGATIVE_CACHE_TTL", defaultNegativeCacheTTL)
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+
+	return failures.NewMemory(size, ttl)
+}
+
+func storeErrorPolicy() (service.StorePolicy, error) {
+	policy := os.Getenv("STORE_ERROR_POLICY")
+	if policy == "" {
+		policy = defaultStoreErrorPolicy
+	}
+
+	switch policy {
+	case "bypass":
+		return service.StoreBypass, nil
+	case "fail":
+		return service.StoreFailFast, nil
+	default:
+		return 0, fmt.Errorf("unknown store error policy %s", policy)
+	}
+}
+
+func downloaderOptions() ([]downloader.Option, error) {
+	opts := []downloader.Option{
+		downloader.AllowHosts(listEnv("ALLOWED_HOSTS")...),
+		downloader.DenyHosts(listEnv("DENIED_HOSTS")...),
+	}
+
+	if schemes := listEnv("ALLOWED_SCHEMES"); len(schemes) > 0 {
+		opts = append(opts, downloader.AllowSchemes(schemes...))
+	}
+
+	opts = append(opts,
+		downloader.MaxSize(int64(intEnv("MAX_SOURCE_SIZE", downloader.DefaultMaxSize))),
+		downloader.Timeouts(
+			durationEnv("CONNECT_TIMEOUT", downloader.DefaultConnectTimeout),
+			durationEnv("READ_TIMEOUT", downloader.DefaultReadTimeout),
+			durationEnv("DOWNLOAD_TIMEOUT", downloader.DefaultTotalTimeout),
+		),
+		downloader.RememberValidators(intEnv("REMEMBERED_VALIDATORS", downloader.DefaultRememberedValidators)),
+	)
+
+	var trusted []*net.IPNet
+	for _, cidr := range listEnv("TRUSTED_NETWORKS") {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_NETWORKS: %s", err)
+		}
+		trusted = append(trusted, n)
+	}
+	opts = append(opts, downloader.TrustNetworks(trusted...))
+
+	return opts, nil
+}
+
+func storeBackend() string {
+	backend := os.Getenv("STORE_BACKEND")
+	if backend == "" {
+		backend = defaultStoreBackend
+	}
+	return backend
+}
+
+func lockerBackend() string {
+	backend := os.Getenv("LOCKER")
+	if backend == "" {
+		backend = defaultLockerBackend
+	}
+	return backend
+}
+
+func fsStorePath() string {
+	path := os.Getenv("FS_STORE_PATH")
+	if path == "" {
+		path = defaultFSStorePath
+	}
+	return path
+}
+
+// redisStorePrefix keeps thumbnails apart from locks, job states and other data in redis
+func redisStorePrefix() string {
+	prefix := os.Getenv("REDIS_STORE_PREFIX")
+	if prefix == "" {
+		prefix = defaultRedisStorePrefix
+	}
+	return prefix
 }
 
 func bucketName() string {
@@ -71,3 +303,75 @@ func awsRegion() string {
 func s3Endpoint() string {
 	return os.Getenv("AWS_S3_ENDPOINT")
 }
+
+func jpegQuality() int {
+	return intEnv("JPEG_QUALITY", defaultQuality)
+}
+
+func maxJpegQuality() int {
+	return intEnv("JPEG_MAX_QUALITY", defaultMaxQuality)
+}
+
+func cacheMaxAge() int {
+	return intEnv("CACHE_MAX_AGE", defaultCacheMaxAge)
+}
+
+func shutdownTimeout() time.Duration {
+	return durationEnv("SHUTDOWN_TIMEOUT", defaultShutdownTimeout)
+}
+
+func requestTimeout() time.Duration {
+	return durationEnv("REQUEST_TIMEOUT", defaultRequestTimeout)
+}
+
+func sourceLimits() transform.Limits {
+	return transform.Limits{
+		MaxWidth:  intEnv("MAX_SOURCE_WIDTH", transform.DefaultLimits.MaxWidth),
+		MaxHeight: intEnv("MAX_SOURCE_HEIGHT", transform.DefaultLimits.MaxHeight),
+		MaxPixels: intEnv("MAX_SOURCE_PIXELS", transform.DefaultLimits.MaxPixels),
+		MaxFrames: intEnv("MAX_SOURCE_FRAMES", transform.DefaultLimits.MaxFrames),
+	}
+}
+
+func signatureSecret() []byte {
+	return []byte(os.Getenv("SIGNATURE_SECRET"))
+}
+
+func intEnv(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	res, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("invalid %s value %s, using default %d\n", name, value, defaultValue)
+		return defaultValue
+	}
+
+	return res
+}
+
+func durationEnv(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	res, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("invalid %s value %s, using default %s\n", name, value, defaultValue)
+		return defaultValue
+	}
+
+	return res
+}
+
+func listEnv(name string) []string {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+
+	return strings.Split(value, ",")
+}
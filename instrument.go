@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/Bobochka/thumbnail_service/lib"
+	"github.com/Bobochka/thumbnail_service/lib/metrics"
+)
+
+// instrumented counts requests by response status and error type, as well as requests being served
+func instrumented(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metrics.InFlight.Inc()
+		defer metrics.InFlight.Dec()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK, errorType: "none"}
+		h(rec, r)
+
+		metrics.Requests.WithLabelValues(strconv.Itoa(rec.status), rec.errorType).Inc()
+	}
+}
+
+// statusRecorder remembers response status, errorType is set by renderError
+type statusRecorder struct {
+	http.ResponseWriter
+	status    int
+	errorType string
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func recordError(w http.ResponseWriter, err error) {
+	rec, ok := w.(*statusRecorder)
+	if !ok {
+		return
+	}
+
+	rec.errorType = "internal"
+	if e, ok := err.(lib.Error); ok {
+		rec.errorType = e.TypeName()
+	}
+}
@@ -0,0 +1,139 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// blockedNetworks are never dialed unless explicitly trusted:
+// loopback, private, link-local (including cloud metadata endpoints) and other special purpose ranges
+var blockedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// TrustNetworks allows dialing to listed networks, which are blocked by default
+func TrustNetworks(nets ...*net.IPNet) Option {
+	return func(d *Http) {
+		d.trustedNetworks = append(d.trustedNetworks, nets...)
+	}
+}
+
+type blockedError struct {
+	ip net.IP
+}
+
+func (e blockedError) Error() string {
+	return fmt.Sprintf("destination %s is not allowed", e.ip)
+}
+
+// safeDialer resolves host names itself and dials only checked addresses,
+// so neither redirects nor DNS rebinding can lead to blocked destinations
+type safeDialer struct {
+	dialer      *net.Dialer
+	trusted     []*net.IPNet
+	readTimeout time.Duration
+}
+
+func (d *safeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		if d.isBlocked(addr.IP) {
+			return nil, blockedError{addr.IP}
+		}
+	}
+
+	var conn net.Conn
+	for _, addr := range addrs {
+		conn, err = d.dialer.DialContext(ctx, network, net.JoinHostPort(addr.IP.String(), port))
+		if err == nil {
+			if d.readTimeout > 0 {
+				conn = &deadlineConn{Conn: conn, timeout: d.readTimeout}
+			}
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+func (d *safeDialer) isBlocked(ip net.IP) bool {
+	for _, n := range d.trusted {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	for _, n := range blockedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newSafeDialer(trusted []*net.IPNet, connectTimeout, readTimeout time.Duration) *safeDialer {
+	return &safeDialer{
+		dialer: &net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		},
+		trusted:     trusted,
+		readTimeout: readTimeout,
+	}
+}
+
+func isBlocked(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case blockedError, policyError:
+			return true
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var res []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		res = append(res, n)
+	}
+	return res
+}
@@ -1,8 +1,13 @@
 package downloader
 
 import (
+	"context"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"time"
 
 	"fmt"
 
@@ -11,39 +16,190 @@ import (
 
 type Http struct {
 	contentTypes map[string]struct{}
+	schemes      map[string]struct{}
+	allowedHosts []string
+	deniedHosts  []string
+
+	trustedNetworks []*net.IPNet
+	client          *http.Client
+	validators      *validatorsCache
+
+	maxSize        int64
+	connectTimeout time.Duration
+	readTimeout    time.Duration
+	totalTimeout   time.Duration
 }
 
-func New(allowedContentTypes []string) *Http {
+func New(allowedContentTypes []string, opts ...Option) *Http {
 	ct := map[string]struct{}{}
 	for _, t := range allowedContentTypes {
 		ct[t] = struct{}{}
 	}
 
-	return &Http{
-		contentTypes: ct,
+	d := &Http{
+		contentTypes:   ct,
+		maxSize:        DefaultMaxSize,
+		connectTimeout: DefaultConnectTimeout,
+		readTimeout:    DefaultReadTimeout,
+		totalTimeout:   DefaultTotalTimeout,
+		validators:     newValidatorsCache(DefaultRememberedValidators),
+	}
+
+	AllowSchemes(defaultSchemes...)(d)
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	dialer := newSafeDialer(d.trustedNetworks, d.connectTimeout, d.readTimeout)
+
+	d.client = &http.Client{
+		Timeout:       d.totalTimeout,
+		CheckRedirect: d.checkRedirect,
+		Transport: &http.Transport{
+			// proxy would hide actual destination from the dialer
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   d.connectTimeout,
+			ResponseHeaderTimeout: d.readTimeout,
+		},
 	}
+
+	return d
+}
+
+// Client is exposed for tests, e.g. to intercept requests
+func (d *Http) Client() *http.Client {
+	return d.client
+}
+
+// Download returns body of the resource at rawurl along with its validators.
+// Once ctx is done, download is aborted with ctx error.
+func (d *Http) Download(ctx context.Context, rawurl string) ([]byte, lib.Validators, error) {
+	return d.download(ctx, rawurl, lib.Validators{})
+}
+
+// DownloadIfModified makes conditional request with validators remembered from the previous download of rawurl.
+// In case origin reports resource is not modified, lib.ErrSourceNotModified is returned along with the validators.
+func (d *Http) DownloadIfModified(ctx context.Context, rawurl string) ([]byte, lib.Validators, error) {
+	v, _ := d.validators.get(rawurl)
+	return d.download(ctx, rawurl, v)
 }
 
-func (d *Http) Download(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+func (d *Http) download(ctx context.Context, rawurl string, conditional lib.Validators) ([]byte, lib.Validators, error) {
+	resp, err := d.do(ctx, rawurl, conditional)
 
 	if resp != nil {
 		defer resp.Body.Close()
 	}
 
+	if err != nil {
+		return nil, lib.Validators{}, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && !conditional.Empty() {
+		return nil, conditional, lib.ErrSourceNotModified
+	}
+
+	data, err := d.read(ctx, resp)
+	if err != nil {
+		return nil, lib.Validators{}, err
+	}
+
+	v := validators(resp)
+	d.validators.set(rawurl, v)
+
+	return data, v, nil
+}
+
+func (d *Http) do(ctx context.Context, rawurl string, conditional lib.Validators) (*http.Response, error) {
+	u, err := url.Parse(rawurl)
 	if err != nil {
 		return nil, lib.NewError(err, lib.ResourceUnreachable)
 	}
 
-	data, err := ioutil.ReadAll(resp.Body)
+	if err := d.checkPolicy(u); err != nil {
+		return nil, lib.NewError(err, lib.ForbiddenSource)
+	}
+
+	req, err := http.NewRequest("GET", rawurl, nil)
 	if err != nil {
 		return nil, lib.NewError(err, lib.ResourceUnreachable)
 	}
+	req = req.WithContext(ctx)
 
-	if resp.StatusCode/100 != 2 {
+	if conditional.ETag != "" {
+		req.Header.Set("If-None-Match", conditional.ETag)
+	}
+
+	if conditional.LastModified != "" {
+		req.Header.Set("If-Modified-Since", conditional.LastModified)
+	}
+
+	resp, err := d.client.Do(req)
+
+	// cancellation tells nothing about the source
+	if err != nil && ctx.Err() != nil {
+		return resp, ctx.Err()
+	}
+
+	if isBlocked(err) {
+		return resp, lib.NewError(err, lib.ForbiddenSource)
+	}
+
+	if isTimeout(err) {
+		return resp, lib.NewError(err, lib.SourceTimeout)
+	}
+
+	if err != nil {
+		return resp, lib.NewError(err, lib.ResourceUnreachable)
+	}
+
+	return resp, nil
+}
+
+// read checks status before the body, as error pages tell nothing about the size of the source
+func (d *Http) read(ctx context.Context, resp *http.Response) ([]byte, error) {
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusGone:
+		err := fmt.Errorf("origin responded with status %d", resp.StatusCode)
+		return nil, lib.NewError(err, lib.SourceNotFound)
+	case resp.StatusCode/100 != 2:
+		err := fmt.Errorf("origin responded with status %d", resp.StatusCode)
+		return nil, lib.NewError(err, lib.ResourceUnreachable)
+	}
+
+	if d.maxSize > 0 && resp.ContentLength > d.maxSize {
+		err := fmt.Errorf("content length %d exceeds limit of %d bytes", resp.ContentLength, d.maxSize)
+		return nil, lib.NewError(err, lib.SourceTooLarge)
+	}
+
+	var body io.Reader = resp.Body
+	if d.maxSize > 0 {
+		// read one byte more than allowed to tell if the limit is exceeded
+		body = io.LimitReader(resp.Body, d.maxSize+1)
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	if isTimeout(err) {
+		return nil, lib.NewError(err, lib.SourceTimeout)
+	}
+
+	if err != nil {
 		return nil, lib.NewError(err, lib.ResourceUnreachable)
 	}
 
+	if d.maxSize > 0 && int64(len(data)) > d.maxSize {
+		err = fmt.Errorf("body exceeds limit of %d bytes", d.maxSize)
+		return nil, lib.NewError(err, lib.SourceTooLarge)
+	}
+
 	t := http.DetectContentType(data)
 	if _, ok := d.contentTypes[t]; !ok {
 		return nil, lib.NewError(fmt.Errorf("content type %s not supported", t), lib.UnsupportedContentType)
@@ -51,3 +207,10 @@ func (d *Http) Download(url string) ([]byte, error) {
 
 	return data, nil
 }
+
+func validators(resp *http.Response) lib.Validators {
+	return lib.Validators{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+}
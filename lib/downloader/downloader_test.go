@@ -1,8 +1,15 @@
 package downloader
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Bobochka/thumbnail_service/lib"
 	. "github.com/onsi/ginkgo"
@@ -16,6 +23,18 @@ func (errReader) Read(p []byte) (n int, err error) {
 	return 0, errors.New("test error")
 }
 
+var textHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("something"))
+})
+
+func cidr(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
 func Test(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Downloader Suite")
@@ -29,23 +48,364 @@ var _ = Describe("Downloader", func() {
 
 	var subject *Http
 	var allowedTypes []string
+	var opts []Option
+
+	BeforeEach(func() {
+		opts = nil
+	})
 
 	JustBeforeEach(func() {
-		subject = New(allowedTypes)
+		subject = New(allowedTypes, opts...)
+		gock.InterceptClient(subject.Client())
 	})
 
 	Describe("Download", func() {
 		var host, path string
 		var data []byte
+		var validators lib.Validators
 		var err error
+		var ctx context.Context
 
 		BeforeEach(func() {
 			host = "http://foo.bar"
 			path = "/baz"
+			ctx = context.Background()
 		})
 
 		JustBeforeEach(func() {
-			data, err = subject.Download(host + path)
+			data, validators, err = subject.Download(ctx, host+path)
+		})
+
+		ItIsForbidden := func() {
+			It("Responds without data", func() {
+				Expect(data).To(BeEmpty())
+			})
+
+			It("Responds with forbidden source error", func() {
+				Expect(err).To(BeAssignableToTypeOf(lib.Error{}))
+				Expect(err.(lib.Error).Code()).To(Equal(403))
+				Expect(err.(lib.Error).Msg()).To(Equal("Downloading from specified url is not allowed"))
+			})
+		}
+
+		Context("When scheme is not allowed", func() {
+			BeforeEach(func() {
+				host = "ftp://foo.bar"
+			})
+
+			ItIsForbidden()
+		})
+
+		Context("When host is denied", func() {
+			BeforeEach(func() {
+				opts = []Option{DenyHosts("*.bar")}
+			})
+
+			ItIsForbidden()
+		})
+
+		Context("When denied host has trailing dot", func() {
+			BeforeEach(func() {
+				host = "http://evil.com."
+				opts = []Option{DenyHosts("evil.com")}
+			})
+
+			ItIsForbidden()
+		})
+
+		Context("When subdomain of denied host has trailing dot", func() {
+			BeforeEach(func() {
+				host = "http://a.evil.com."
+				opts = []Option{DenyHosts("*.evil.com")}
+			})
+
+			ItIsForbidden()
+		})
+
+		Context("When host is not allowed", func() {
+			BeforeEach(func() {
+				opts = []Option{AllowHosts("bar", "*.foo.bar")}
+			})
+
+			ItIsForbidden()
+		})
+
+		Context("When host is allowed", func() {
+			BeforeEach(func() {
+				allowedTypes = []string{"text/plain; charset=utf-8"}
+				opts = []Option{AllowHosts("*.com", "FOO.bar"), DenyHosts("*.foo.bar")}
+
+				gock.New(host).
+					Get(path).
+					Reply(200).
+					BodyString("something")
+			})
+
+			It("Responds with data", func() {
+				Expect(data).To(Equal([]byte(`something`)))
+			})
+		})
+
+		Context("When allowed host has trailing dot", func() {
+			BeforeEach(func() {
+				host = "http://a.foo.bar."
+				allowedTypes = []string{"text/plain; charset=utf-8"}
+				opts = []Option{AllowHosts("*.foo.bar")}
+
+				gock.New(host).
+					Get(path).
+					Reply(200).
+					BodyString("something")
+			})
+
+			It("Responds with data", func() {
+				Expect(data).To(Equal([]byte(`something`)))
+			})
+		})
+
+		Context("When allowed host pattern has trailing dot", func() {
+			BeforeEach(func() {
+				allowedTypes = []string{"text/plain; charset=utf-8"}
+				opts = []Option{AllowHosts("foo.bar.")}
+
+				gock.New(host).
+					Get(path).
+					Reply(200).
+					BodyString("something")
+			})
+
+			It("Responds with data", func() {
+				Expect(data).To(Equal([]byte(`something`)))
+			})
+		})
+
+		Describe("Destination protection", func() {
+			var server *httptest.Server
+
+			BeforeEach(func() {
+				allowedTypes = []string{"text/plain; charset=utf-8"}
+				path = "/"
+			})
+
+			AfterEach(func() {
+				server.Close()
+			})
+
+			Context("When destination is loopback", func() {
+				BeforeEach(func() {
+					server = httptest.NewServer(textHandler)
+					host = server.URL
+				})
+
+				ItIsForbidden()
+
+				Context("When loopback is trusted", func() {
+					BeforeEach(func() {
+						opts = []Option{TrustNetworks(cidr("127.0.0.0/8"))}
+					})
+
+					It("Responds with data", func() {
+						Expect(err).NotTo(HaveOccurred())
+						Expect(data).To(Equal([]byte(`something`)))
+					})
+				})
+			})
+
+			Context("When host name resolves to loopback", func() {
+				BeforeEach(func() {
+					server = httptest.NewServer(textHandler)
+					host = strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+				})
+
+				ItIsForbidden()
+			})
+
+			Context("When redirected to blocked destination", func() {
+				var target *httptest.Server
+
+				BeforeEach(func() {
+					target = httptest.NewUnstartedServer(textHandler)
+					listener, e := net.Listen("tcp", "127.0.0.2:0")
+					Expect(e).NotTo(HaveOccurred())
+					target.Listener = listener
+					target.Start()
+
+					server = httptest.NewServer(http.RedirectHandler(target.URL, http.StatusFound))
+					host = server.URL
+
+					opts = []Option{TrustNetworks(cidr("127.0.0.1/32"))}
+				})
+
+				AfterEach(func() {
+					target.Close()
+				})
+
+				ItIsForbidden()
+			})
+
+			Context("When redirected to host that is not allowed", func() {
+				var target *httptest.Server
+
+				BeforeEach(func() {
+					target = httptest.NewServer(textHandler)
+
+					redirect := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+					server = httptest.NewServer(http.RedirectHandler(redirect, http.StatusFound))
+					host = server.URL
+
+					opts = []Option{AllowHosts("127.0.0.1"), TrustNetworks(cidr("127.0.0.0/8"))}
+				})
+
+				AfterEach(func() {
+					target.Close()
+				})
+
+				ItIsForbidden()
+			})
+		})
+
+		Describe("Limits", func() {
+			var server *httptest.Server
+			var handler http.HandlerFunc
+
+			BeforeEach(func() {
+				allowedTypes = []string{"text/plain; charset=utf-8"}
+				path = "/"
+				opts = []Option{TrustNetworks(cidr("127.0.0.0/8"))}
+
+				server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					handler(w, r)
+				}))
+				host = server.URL
+			})
+
+			AfterEach(func() {
+				server.Close()
+			})
+
+			ItFailsWith := func(code int) {
+				It("Responds without data", func() {
+					Expect(data).To(BeEmpty())
+				})
+
+				It(fmt.Sprintf("Responds with error code %d", code), func() {
+					Expect(err).To(BeAssignableToTypeOf(lib.Error{}))
+					Expect(err.(lib.Error).Code()).To(Equal(code))
+				})
+			}
+
+			Context("When content length exceeds max size", func() {
+				BeforeEach(func() {
+					opts = append(opts, MaxSize(5))
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						w.Write([]byte("something"))
+					}
+				})
+
+				ItFailsWith(413)
+			})
+
+			Context("When streamed body exceeds max size", func() {
+				BeforeEach(func() {
+					opts = append(opts, MaxSize(5))
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						for i := 0; i < 3; i++ {
+							w.Write([]byte("some"))
+							w.(http.Flusher).Flush()
+						}
+					}
+				})
+
+				ItFailsWith(413)
+			})
+
+			Context("When error page exceeds max size", func() {
+				BeforeEach(func() {
+					opts = append(opts, MaxSize(5))
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						http.Error(w, "not found at all", http.StatusNotFound)
+					}
+				})
+
+				ItFailsWith(404)
+			})
+
+			Context("When body fits max size", func() {
+				BeforeEach(func() {
+					opts = append(opts, MaxSize(9))
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						w.Write([]byte("something"))
+					}
+				})
+
+				It("Responds with data", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(data).To(Equal([]byte("something")))
+				})
+			})
+
+			Context("When origin is slow to respond", func() {
+				BeforeEach(func() {
+					opts = append(opts, Timeouts(time.Second, 50*time.Millisecond, time.Second))
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						time.Sleep(200 * time.Millisecond)
+						w.Write([]byte("something"))
+					}
+				})
+
+				ItFailsWith(504)
+			})
+
+			Context("When origin stalls in the middle of body", func() {
+				BeforeEach(func() {
+					opts = append(opts, Timeouts(time.Second, 50*time.Millisecond, time.Second))
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						w.Write([]byte("some"))
+						w.(http.Flusher).Flush()
+						time.Sleep(200 * time.Millisecond)
+						w.Write([]byte("thing"))
+					}
+				})
+
+				ItFailsWith(504)
+			})
+
+			Context("When download takes too long in total", func() {
+				BeforeEach(func() {
+					opts = append(opts, Timeouts(time.Second, time.Second, 100*time.Millisecond))
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						for i := 0; i < 10; i++ {
+							w.Write([]byte("some"))
+							w.(http.Flusher).Flush()
+							time.Sleep(30 * time.Millisecond)
+						}
+					}
+				})
+
+				ItFailsWith(504)
+			})
+
+			Context("When caller gives up", func() {
+				var cancel context.CancelFunc
+
+				BeforeEach(func() {
+					ctx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+
+					handler = func(w http.ResponseWriter, r *http.Request) {
+						time.Sleep(200 * time.Millisecond)
+						w.Write([]byte("something"))
+					}
+				})
+
+				AfterEach(func() {
+					cancel()
+				})
+
+				It("Responds with caller's error", func() {
+					Expect(data).To(BeEmpty())
+					Expect(err).To(Equal(context.DeadlineExceeded))
+				})
+			})
 		})
 
 		Context("When request failure", func() {
@@ -84,6 +444,20 @@ var _ = Describe("Downloader", func() {
 			})
 		})
 
+		Context("When source is missing", func() {
+			BeforeEach(func() {
+				gock.New(host).
+					Get(path).
+					Reply(404)
+			})
+
+			It("Responds with not found error", func() {
+				Expect(err).To(BeAssignableToTypeOf(lib.Error{}))
+				Expect(err.(lib.Error).Type()).To(Equal(lib.SourceNotFound))
+				Expect(err.(lib.Error).Code()).To(Equal(404))
+			})
+		})
+
 		Context("When can't read body", func() {
 			BeforeEach(func() {
 				gock.New(host).
@@ -134,6 +508,8 @@ var _ = Describe("Downloader", func() {
 				gock.New(host).
 					Get(path).
 					Reply(200).
+					SetHeader("ETag", `"v1"`).
+					SetHeader("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT").
 					BodyString("something")
 			})
 
@@ -141,10 +517,93 @@ var _ = Describe("Downloader", func() {
 				Expect(data).To(Equal([]byte(`something`)))
 			})
 
+			It("Responds with validators", func() {
+				Expect(validators).To(Equal(lib.Validators{ETag: `"v1"`, LastModified: "Mon, 02 Jan 2006 15:04:05 GMT"}))
+			})
+
 			It("Responds without error", func() {
 				Expect(err).NotTo(HaveOccurred())
 			})
 		})
 	})
 
+	Describe("DownloadIfModified", func() {
+		var data []byte
+		var validators lib.Validators
+		var err error
+		var downloadedBefore bool
+
+		BeforeEach(func() {
+			allowedTypes = []string{"text/plain; charset=utf-8"}
+			downloadedBefore = false
+		})
+
+		JustBeforeEach(func() {
+			if downloadedBefore {
+				_, _, e := subject.Download(context.Background(), "http://foo.bar/baz")
+				Expect(e).NotTo(HaveOccurred())
+			}
+
+			data, validators, err = subject.DownloadIfModified(context.Background(), "http://foo.bar/baz")
+		})
+
+		Context("When url was not downloaded before", func() {
+			BeforeEach(func() {
+				gock.New("http://foo.bar").
+					Get("/baz").
+					Reply(200).
+					BodyString("something")
+			})
+
+			It("Downloads unconditionally", func() {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(data).To(Equal([]byte("something")))
+			})
+		})
+
+		Context("When url was downloaded before", func() {
+			BeforeEach(func() {
+				downloadedBefore = true
+
+				gock.New("http://foo.bar").
+					Get("/baz").
+					Reply(200).
+					SetHeader("ETag", `"v1"`).
+					BodyString("something")
+			})
+
+			Context("When source is not modified", func() {
+				BeforeEach(func() {
+					gock.New("http://foo.bar").
+						Get("/baz").
+						MatchHeader("If-None-Match", `"v1"`).
+						Reply(304)
+				})
+
+				It("Reports source is not modified", func() {
+					Expect(err).To(Equal(lib.ErrSourceNotModified))
+					Expect(data).To(BeEmpty())
+					Expect(validators).To(Equal(lib.Validators{ETag: `"v1"`}))
+				})
+			})
+
+			Context("When source is modified", func() {
+				BeforeEach(func() {
+					gock.New("http://foo.bar").
+						Get("/baz").
+						MatchHeader("If-None-Match", `"v1"`).
+						Reply(200).
+						SetHeader("ETag", `"v2"`).
+						BodyString("something else")
+				})
+
+				It("Responds with new data and validators", func() {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(data).To(Equal([]byte("something else")))
+					Expect(validators).To(Equal(lib.Validators{ETag: `"v2"`}))
+				})
+			})
+		})
+	})
+
 })
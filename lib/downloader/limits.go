@@ -0,0 +1,52 @@
+package downloader
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	DefaultMaxSize        = 20 << 20 // bytes
+	DefaultConnectTimeout = 5 * time.Second
+	DefaultReadTimeout    = 10 * time.Second
+	DefaultTotalTimeout   = 30 * time.Second
+)
+
+// MaxSize limits size of downloaded body, no limit if zero
+func MaxSize(bytes int64) Option {
+	return func(d *Http) {
+		d.maxSize = bytes
+	}
+}
+
+// Timeouts sets limits on:
+// connect - establishing tcp connection,
+// read - waiting for the next chunk of data from origin,
+// total - the whole download including redirects and reading the body.
+// Zero value means no limit
+func Timeouts(connect, read, total time.Duration) Option {
+	return func(d *Http) {
+		d.connectTimeout = connect
+		d.readTimeout = read
+		d.totalTimeout = total
+	}
+}
+
+// deadlineConn extends read deadline before each read,
+// so that origin that stops sending data is detected early
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
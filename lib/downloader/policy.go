@@ -0,0 +1,108 @@
+package downloader
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type Option func(*Http)
+
+// AllowHosts restricts downloads to listed hosts only.
+// Host pattern is either exact host name or `*.example.com` matching any subdomain of example.com
+func AllowHosts(patterns ...string) Option {
+	return func(d *Http) {
+		d.allowedHosts = append(d.allowedHosts, normalizePatterns(patterns)...)
+	}
+}
+
+// DenyHosts forbids downloads from listed hosts, takes precedence over AllowHosts
+func DenyHosts(patterns ...string) Option {
+	return func(d *Http) {
+		d.deniedHosts = append(d.deniedHosts, normalizePatterns(patterns)...)
+	}
+}
+
+// AllowSchemes overrides default http and https schemes
+func AllowSchemes(schemes ...string) Option {
+	return func(d *Http) {
+		d.schemes = map[string]struct{}{}
+		for _, s := range normalizePatterns(schemes) {
+			d.schemes[s] = struct{}{}
+		}
+	}
+}
+
+var defaultSchemes = []string{"http", "https"}
+
+// maxRedirects matches default limit of http.Client
+const maxRedirects = 10
+
+type policyError struct {
+	err error
+}
+
+func (e policyError) Error() string {
+	return e.err.Error()
+}
+
+// checkRedirect applies policy to every hop, otherwise allowed host could redirect anywhere
+func (d *Http) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+
+	if err := d.checkPolicy(req.URL); err != nil {
+		return policyError{err}
+	}
+
+	return nil
+}
+
+func (d *Http) checkPolicy(u *url.URL) error {
+	scheme := strings.ToLower(u.Scheme)
+	if _, ok := d.schemes[scheme]; !ok {
+		return fmt.Errorf("scheme %s is not allowed", scheme)
+	}
+
+	// fully qualified name with trailing dot is the same host
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+
+	if matchesAny(host, d.deniedHosts) {
+		return fmt.Errorf("host %s is denied", host)
+	}
+
+	if len(d.allowedHosts) > 0 && !matchesAny(host, d.allowedHosts) {
+		return fmt.Errorf("host %s is not allowed", host)
+	}
+
+	return nil
+}
+
+func matchesAny(host string, patterns []string) bool {
+	for _, p := range patterns {
+		if matches(host, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func matches(host, pattern string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+func normalizePatterns(patterns []string) []string {
+	var res []string
+	for _, p := range patterns {
+		p = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(p)), ".")
+		if p != "" {
+			res = append(res, p)
+		}
+	}
+	return res
+}
@@ -0,0 +1,65 @@
+package downloader
+
+import (
+	"sync"
+
+	"github.com/Bobochka/thumbnail_service/lib"
+	"github.com/Bobochka/thumbnail_service/lib/lru"
+)
+
+const DefaultRememberedValidators = 10000 // urls
+
+// RememberValidators limits number of urls validators are remembered for,
+// validators are not remembered if zero
+func RememberValidators(urls int) Option {
+	return func(d *Http) {
+		d.validators = newValidatorsCache(urls)
+	}
+}
+
+// validatorsCache keeps validators of recently downloaded urls, nil cache keeps nothing
+type validatorsCache struct {
+	mu  sync.Mutex
+	lru *lru.Cache // of lib.Validators
+}
+
+func newValidatorsCache(maxEntries int) *validatorsCache {
+	if maxEntries <= 0 {
+		return nil
+	}
+
+	return &validatorsCache{lru: lru.New(int64(maxEntries), nil)}
+}
+
+func (c *validatorsCache) get(url string) (lib.Validators, bool) {
+	if c == nil {
+		return lib.Validators{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.lru.Get(url)
+	if !ok {
+		return lib.Validators{}, false
+	}
+
+	return v.(lib.Validators), true
+}
+
+// set forgets url if validators are empty, as there's nothing to revalidate with
+func (c *validatorsCache) set(url string, v lib.Validators) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if v.Empty() {
+		c.lru.Remove(url)
+		return
+	}
+
+	c.lru.Set(url, v, 1)
+}
@@ -1,5 +1,7 @@
 package lib
 
+import "errors"
+
 type Error struct {
 	cause       error
 	t           int
@@ -12,6 +14,16 @@ const (
 	TransformationFailure
 	EncodingFailure
 	InvalidParams
+	InvalidSignature
+	ForbiddenSource
+	SourceTooLarge
+	SourceTimeout
+	ImageTooLarge
+	StoreUnavailable
+	RequestTimeout
+	ShuttingDown
+	SourceNotFound
+	RequestCancelled
 )
 
 var codeMap = map[int]int{
@@ -20,6 +32,16 @@ var codeMap = map[int]int{
 	TransformationFailure:  500,
 	EncodingFailure:        500,
 	InvalidParams:          400,
+	InvalidSignature:       403,
+	ForbiddenSource:        403,
+	SourceTooLarge:         413,
+	SourceTimeout:          504,
+	ImageTooLarge:          413,
+	StoreUnavailable:       503,
+	RequestTimeout:         504,
+	ShuttingDown:           503,
+	SourceNotFound:         404,
+	RequestCancelled:       499, // nginx convention, client is gone anyway
 }
 
 var msgMap = map[int]string{
@@ -28,6 +50,35 @@ var msgMap = map[int]string{
 	TransformationFailure:  "Sorry, but something went wrong, our support engineers are already notified",
 	EncodingFailure:        "Sorry, but something went wrong, our support engineers are already notified",
 	InvalidParams:          "Request params are invalid, please, verify that url is a valid url, width and height are positive integers",
+	InvalidSignature:       "Request signature is missing, invalid or expired",
+	ForbiddenSource:        "Downloading from specified url is not allowed",
+	SourceTooLarge:         "Image at specified url is too large",
+	SourceTimeout:          "Timed out downloading specified url",
+	ImageTooLarge:          "Image at specified url has too large dimensions",
+	StoreUnavailable:       "Service is temporarily unavailable, please, try again later",
+	RequestTimeout:         "Timed out processing the request, please, try again later",
+	ShuttingDown:           "Service is shutting down, please, try again later",
+	SourceNotFound:         "Unable to access specified url",
+	RequestCancelled:       "Request was cancelled by the client",
+}
+
+// nameMap identifies error types in logs and metrics
+var nameMap = map[int]string{
+	ResourceUnreachable:    "resource_unreachable",
+	UnsupportedContentType: "unsupported_content_type",
+	TransformationFailure:  "transformation_failure",
+	EncodingFailure:        "encoding_failure",
+	InvalidParams:          "invalid_params",
+	InvalidSignature:       "invalid_signature",
+	ForbiddenSource:        "forbidden_source",
+	SourceTooLarge:         "source_too_large",
+	SourceTimeout:          "source_timeout",
+	ImageTooLarge:          "image_too_large",
+	StoreUnavailable:       "store_unavailable",
+	RequestTimeout:         "request_timeout",
+	ShuttingDown:           "shutting_down",
+	SourceNotFound:         "source_not_found",
+	RequestCancelled:       "request_cancelled",
 }
 
 func NewError(cause error, t int, msgOverride ...string) Error {
@@ -55,6 +106,20 @@ func (e Error) Error() string {
 	return ""
 }
 
+// Type is one of the error types, e.g. ResourceUnreachable
+func (e Error) Type() int {
+	return e.t
+}
+
+func (e Error) TypeName() string {
+	name, ok := nameMap[e.t]
+	if ok {
+		return name
+	}
+
+	return "unknown"
+}
+
 func (e Error) Code() int {
 	code, ok := codeMap[e.t]
 	if ok {
@@ -78,3 +143,29 @@ func (e Error) Msg() string {
 
 	return GenericMsg
 }
+
+// ErrorMessage is serializable form of error, which keeps type of lib.Error,
+// so that errors can be passed between processes
+type ErrorMessage struct {
+	Type  *int   `json:"type,omitempty"`
+	Error string `json:"error"`
+}
+
+func NewErrorMessage(err error) ErrorMessage {
+	msg := ErrorMessage{Error: err.Error()}
+	if e, ok := err.(Error); ok {
+		t := e.Type()
+		msg.Type = &t
+	}
+
+	return msg
+}
+
+func (m ErrorMessage) Err() error {
+	err := errors.New(m.Error)
+	if m.Type != nil {
+		return NewError(err, *m.Type)
+	}
+
+	return err
+}
@@ -0,0 +1,56 @@
+package failures
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Bobochka/thumbnail_service/lib"
+	"github.com/Bobochka/thumbnail_service/lib/lru"
+)
+
+// Memory is an in-process negative cache bounded by number of entries,
+// failures are forgotten after ttl, least recently used ones are dropped first.
+type Memory struct {
+	ttl time.Duration
+
+	mu  sync.Mutex
+	lru *lru.Cache // of memoryEntry
+}
+
+type memoryEntry struct {
+	err     lib.Error
+	expires time.Time
+}
+
+func NewMemory(maxEntries int, ttl time.Duration) *Memory {
+	return &Memory{
+		ttl: ttl,
+		lru: lru.New(int64(maxEntries), nil),
+	}
+}
+
+func (m *Memory) Get(ctx context.Context, key string) (lib.Error, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok := m.lru.Get(key)
+	if !ok {
+		return lib.Error{}, false
+	}
+
+	entry := v.(memoryEntry)
+	if !time.Now().Before(entry.expires) {
+		m.lru.Remove(key)
+		return lib.Error{}, false
+	}
+
+	return entry.err, true
+}
+
+func (m *Memory) Set(ctx context.Context, key string, err lib.Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lru.Set(key, memoryEntry{err, time.Now().Add(m.ttl)}, 1)
+}
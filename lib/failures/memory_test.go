@@ -0,0 +1,52 @@
+package failures
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Bobochka/thumbnail_service/lib"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func Test(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Failures Suite")
+}
+
+var ctx = context.Background()
+
+var _ = Describe("Memory", func() {
+	var subject *Memory
+	var failure lib.Error
+
+	BeforeEach(func() {
+		subject = NewMemory(2, 50*time.Millisecond)
+		failure = lib.NewError(errors.New("oups"), lib.UnsupportedContentType)
+	})
+
+	It("Returns remembered failure", func() {
+		subject.Set(ctx, "a", failure)
+
+		err, ok := subject.Get(ctx, "a")
+		Expect(ok).To(BeTrue())
+		Expect(err.Type()).To(Equal(lib.UnsupportedContentType))
+		Expect(err.Code()).To(Equal(400))
+	})
+
+	It("Misses unknown key", func() {
+		_, ok := subject.Get(ctx, "a")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("Forgets failure after ttl", func() {
+		subject.Set(ctx, "a", failure)
+
+		time.Sleep(60 * time.Millisecond)
+
+		_, ok := subject.Get(ctx, "a")
+		Expect(ok).To(BeFalse())
+	})
+})
@@ -0,0 +1,39 @@
+package index
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Bobochka/thumbnail_service/lib/lru"
+	"github.com/Bobochka/thumbnail_service/lib/service"
+)
+
+// Memory is an in-process index bounded by number of entries,
+// least recently used entries are dropped first.
+type Memory struct {
+	mu  sync.Mutex
+	lru *lru.Cache // of service.IndexEntry
+}
+
+func NewMemory(maxEntries int) *Memory {
+	return &Memory{lru: lru.New(int64(maxEntries), nil)}
+}
+
+func (m *Memory) Get(ctx context.Context, key string) (service.IndexEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok := m.lru.Get(key)
+	if !ok {
+		return service.IndexEntry{}, false
+	}
+
+	return v.(service.IndexEntry), true
+}
+
+func (m *Memory) Set(ctx context.Context, key string, entry service.IndexEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lru.Set(key, entry, 1)
+}
@@ -0,0 +1,38 @@
+package index
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Bobochka/thumbnail_service/lib/service"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func Test(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Index Suite")
+}
+
+var ctx = context.Background()
+
+var _ = Describe("Memory", func() {
+	var subject *Memory
+
+	BeforeEach(func() {
+		subject = NewMemory(2)
+	})
+
+	It("Returns set entry", func() {
+		subject.Set(ctx, "a", service.IndexEntry{Fingerprint: "fa"})
+
+		entry, ok := subject.Get(ctx, "a")
+		Expect(ok).To(BeTrue())
+		Expect(entry.Fingerprint).To(Equal("fa"))
+	})
+
+	It("Reports unknown key", func() {
+		_, ok := subject.Get(ctx, "a")
+		Expect(ok).To(BeFalse())
+	})
+})
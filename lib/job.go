@@ -0,0 +1,16 @@
+package lib
+
+type JobStatus int
+
+const (
+	JobPending JobStatus = iota + 1
+	JobDone
+	JobFailed
+)
+
+// JobState is the outcome of the work on key, shared between processes
+type JobState struct {
+	Status JobStatus
+	// Err is set for failed job
+	Err error
+}
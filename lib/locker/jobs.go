@@ -0,0 +1,155 @@
+package locker
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Bobochka/thumbnail_service/lib"
+	goRedis "github.com/garyburd/redigo/redis"
+)
+
+// RedisJobs keeps job states in redis, they expire along with the locks.
+// Cancellation is checked before the call only, as redis calls are short.
+type RedisJobs struct {
+	pool   *goRedis.Pool
+	prefix string
+}
+
+// record is stored job state, lib.Error is kept with its type
+type record struct {
+	Status  lib.JobStatus     `json:"status"`
+	Failure *lib.ErrorMessage `json:"failure,omitempty"`
+}
+
+func NewRedisJobs(pool *goRedis.Pool, prefix string) *RedisJobs {
+	return &RedisJobs{pool: pool, prefix: prefix}
+}
+
+// Get reports state as missing in case redis is not able to tell
+func (j *RedisJobs) Get(ctx context.Context, key string) (lib.JobState, bool) {
+	if ctx.Err() != nil {
+		return lib.JobState{}, false
+	}
+
+	conn := j.pool.Get()
+	defer conn.Close()
+
+	data, err := goRedis.Bytes(conn.Do("GET", j.prefix+key))
+	if err == goRedis.ErrNil {
+		return lib.JobState{}, false
+	}
+
+	if err != nil {
+		log.Printf("unable to get job state from redis: %+v\n", err)
+		return lib.JobState{}, false
+	}
+
+	var rec record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		log.Printf("invalid job state %s: %+v\n", data, err)
+		return lib.JobState{}, false
+	}
+
+	return decodeState(rec), true
+}
+
+func (j *RedisJobs) Set(ctx context.Context, key string, state lib.JobState) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(encodeState(state))
+	if err != nil {
+		return err
+	}
+
+	conn := j.pool.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("SET", j.prefix+key, data, "PX", int64(expiry/time.Millisecond))
+
+	return err
+}
+
+func encodeState(state lib.JobState) record {
+	rec := record{Status: state.Status}
+	if state.Err != nil {
+		failure := lib.NewErrorMessage(state.Err)
+		rec.Failure = &failure
+	}
+
+	return rec
+}
+
+func decodeState(rec record) lib.JobState {
+	state := lib.JobState{Status: rec.Status}
+	if rec.Failure != nil {
+		state.Err = rec.Failure.Err()
+	}
+
+	return state
+}
+
+// MemoryJobs keeps job states within the process, companion of MemoryLocker
+type MemoryJobs struct {
+	expiry time.Duration
+
+	mu        sync.Mutex
+	states    map[string]memoryJob
+	lastSweep time.Time
+}
+
+type memoryJob struct {
+	state   lib.JobState
+	expires time.Time
+}
+
+func NewMemoryJobs() *MemoryJobs {
+	return &MemoryJobs{
+		expiry:    expiry,
+		states:    map[string]memoryJob{},
+		lastSweep: time.Now(),
+	}
+}
+
+func (j *MemoryJobs) Get(ctx context.Context, key string) (lib.JobState, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job, ok := j.states[key]
+	if !ok || !time.Now().Before(job.expires) {
+		return lib.JobState{}, false
+	}
+
+	return job.state, true
+}
+
+func (j *MemoryJobs) Set(ctx context.Context, key string, state lib.JobState) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	j.sweep(now)
+
+	j.states[key] = memoryJob{state, now.Add(j.expiry)}
+
+	return nil
+}
+
+// sweep drops expired states at most once per expiry, expects mu to be held
+func (j *MemoryJobs) sweep(now time.Time) {
+	if now.Sub(j.lastSweep) < j.expiry {
+		return
+	}
+
+	for key, job := range j.states {
+		if !now.Before(job.expires) {
+			delete(j.states, key)
+		}
+	}
+
+	j.lastSweep = now
+}
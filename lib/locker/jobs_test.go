@@ -0,0 +1,64 @@
+package locker
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Bobochka/thumbnail_service/lib"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MemoryJobs", func() {
+	var subject *MemoryJobs
+	ctx := context.Background()
+
+	BeforeEach(func() {
+		subject = NewMemoryJobs()
+		subject.expiry = 50 * time.Millisecond
+	})
+
+	It("Misses unknown job", func() {
+		_, ok := subject.Get(ctx, "a")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("Returns the latest state", func() {
+		Expect(subject.Set(ctx, "a", lib.JobState{Status: lib.JobPending})).To(Succeed())
+		Expect(subject.Set(ctx, "a", lib.JobState{Status: lib.JobDone})).To(Succeed())
+
+		state, ok := subject.Get(ctx, "a")
+		Expect(ok).To(BeTrue())
+		Expect(state.Status).To(Equal(lib.JobDone))
+	})
+
+	It("Forgets state after expiry", func() {
+		Expect(subject.Set(ctx, "a", lib.JobState{Status: lib.JobDone})).To(Succeed())
+
+		time.Sleep(60 * time.Millisecond)
+
+		_, ok := subject.Get(ctx, "a")
+		Expect(ok).To(BeFalse())
+	})
+})
+
+var _ = Describe("Redis job record", func() {
+	It("Keeps status", func() {
+		state := decodeState(encodeState(lib.JobState{Status: lib.JobPending}))
+
+		Expect(state.Status).To(Equal(lib.JobPending))
+		Expect(state.Err).To(BeNil())
+	})
+
+	It("Keeps type of lib.Error", func() {
+		state := decodeState(encodeState(lib.JobState{
+			Status: lib.JobFailed,
+			Err:    lib.NewError(errors.New("oups"), lib.TransformationFailure),
+		}))
+
+		Expect(state.Status).To(Equal(lib.JobFailed))
+		Expect(state.Err).To(BeAssignableToTypeOf(lib.Error{}))
+		Expect(state.Err.(lib.Error).Type()).To(Equal(lib.TransformationFailure))
+	})
+})
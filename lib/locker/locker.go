@@ -1,17 +1,31 @@
 package locker
 
 import (
+	"context"
 	"time"
 
 	"github.com/Bobochka/thumbnail_service/lib"
+	goRedis "github.com/garyburd/redigo/redis"
 	"gopkg.in/redsync.v1"
 )
 
+// mutex settings shared by lockers
+const (
+	tries      = 3
+	expiry     = 5 * time.Second
+	retryDelay = 200 * time.Millisecond
+)
+
+// RedisLocker keeps mutexes under prefixed keys, so that they are not mistaken for other data in redis
 type RedisLocker struct {
 	*redsync.Redsync
+	pool   *goRedis.Pool
+	prefix string
 }
 
-func New(host string) (*RedisLocker, error) {
+// NewPool connects to redis, the pool is meant to be shared with other redis backed components,
+// closing it is up to the caller
+func NewPool(host string) (*goRedis.Pool, error) {
 	pool := newPool(host)
 
 	conn := pool.Get()
@@ -22,18 +36,51 @@ func New(host string) (*RedisLocker, error) {
 		return nil, err
 	}
 
-	cleanupHook(pool)
+	return pool, nil
+}
 
+func New(pool *goRedis.Pool, prefix string) *RedisLocker {
 	return &RedisLocker{
-		redsync.New([]redsync.Pool{pool}),
-	}, nil
+		Redsync: redsync.New([]redsync.Pool{pool}),
+		pool:    pool,
+		prefix:  prefix,
+	}
 }
 
 func (r *RedisLocker) NewMutex(name string) lib.Mutex {
-	return r.Redsync.NewMutex(
-		name,
-		redsync.SetTries(3),
-		redsync.SetExpiry(5*time.Second),
-		redsync.SetRetryDelay(200*time.Millisecond),
+	mutex := r.Redsync.NewMutex(
+		r.prefix+name,
+		redsync.SetTries(tries),
+		redsync.SetExpiry(expiry),
+		redsync.SetRetryDelay(retryDelay),
 	)
+
+	return redisMutex{Mutex: mutex, pool: r.pool}
+}
+
+// redisMutex is not tried once cancelled, redsync retries are bounded by tries anyway
+type redisMutex struct {
+	*redsync.Mutex
+	pool *goRedis.Pool
+}
+
+func (m redisMutex) Lock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := m.Mutex.Lock()
+	if err != redsync.ErrFailed {
+		return err
+	}
+
+	// redsync fails the same way whether the lock is taken or redis is unavailable
+	conn := m.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("PING"); err != nil {
+		return err
+	}
+
+	return lib.ErrLockTaken
 }
@@ -0,0 +1,26 @@
+package locker
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Bobochka/thumbnail_service/lib"
+	goRedis "github.com/garyburd/redigo/redis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RedisLocker", func() {
+	It("Tells unavailable redis from taken lock", func() {
+		pool := &goRedis.Pool{
+			Dial: func() (goRedis.Conn, error) {
+				return nil, errors.New("redis is down")
+			},
+		}
+
+		err := New(pool, "lock:").NewMutex("a").Lock(context.Background())
+
+		Expect(err).To(HaveOccurred())
+		Expect(err).NotTo(Equal(lib.ErrLockTaken))
+	})
+})
@@ -0,0 +1,147 @@
+package locker
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Bobochka/thumbnail_service/lib"
+)
+
+var ErrLockTaken = lib.ErrLockTaken
+
+// MemoryLocker is an in-process locker for single instance deployments and tests.
+// Its mutexes expire and extend the same way redis ones do.
+type MemoryLocker struct {
+	tries      int
+	expiry     time.Duration
+	retryDelay time.Duration
+
+	mu        sync.Mutex
+	locks     map[string]memoryLock
+	lastSweep time.Time
+	tokens    uint64
+}
+
+type memoryLock struct {
+	token   uint64
+	expires time.Time
+}
+
+func NewMemory() *MemoryLocker {
+	return &MemoryLocker{
+		tries:      tries,
+		expiry:     expiry,
+		retryDelay: retryDelay,
+		locks:      map[string]memoryLock{},
+		lastSweep:  time.Now(),
+	}
+}
+
+func (l *MemoryLocker) NewMutex(name string) lib.Mutex {
+	return &MemoryMutex{
+		locker: l,
+		name:   name,
+		token:  atomic.AddUint64(&l.tokens, 1),
+	}
+}
+
+type MemoryMutex struct {
+	locker *MemoryLocker
+	name   string
+	token  uint64
+}
+
+func (m *MemoryMutex) Lock(ctx context.Context) error {
+	for i := 0; i < m.locker.tries; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(m.locker.retryDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if m.locker.acquire(m.name, m.token) {
+			return nil
+		}
+	}
+
+	return ErrLockTaken
+}
+
+// Unlock reports whether mutex was still held
+func (m *MemoryMutex) Unlock() bool {
+	return m.locker.release(m.name, m.token)
+}
+
+// Extend resets expiry, reports whether mutex was still held
+func (m *MemoryMutex) Extend() bool {
+	return m.locker.extend(m.name, m.token)
+}
+
+func (l *MemoryLocker) acquire(name string, token uint64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	if lock, ok := l.locks[name]; ok && now.Before(lock.expires) {
+		return false
+	}
+
+	l.locks[name] = memoryLock{token, now.Add(l.expiry)}
+
+	return true
+}
+
+func (l *MemoryLocker) release(name string, token uint64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.holds(name, token, time.Now()) {
+		return false
+	}
+
+	delete(l.locks, name)
+
+	return true
+}
+
+func (l *MemoryLocker) extend(name string, token uint64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if !l.holds(name, token, now) {
+		return false
+	}
+
+	l.locks[name] = memoryLock{token, now.Add(l.expiry)}
+
+	return true
+}
+
+// holds expects mu to be held
+func (l *MemoryLocker) holds(name string, token uint64, now time.Time) bool {
+	lock, ok := l.locks[name]
+	return ok && lock.token == token && now.Before(lock.expires)
+}
+
+// sweep drops expired locks, which are never unlocked after successful extend.
+// Runs at most once per expiry, expects mu to be held
+func (l *MemoryLocker) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.expiry {
+		return
+	}
+
+	for name, lock := range l.locks {
+		if !now.Before(lock.expires) {
+			delete(l.locks, name)
+		}
+	}
+
+	l.lastSweep = now
+}
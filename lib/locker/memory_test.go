@@ -0,0 +1,95 @@
+package locker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func Test(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Locker Suite")
+}
+
+var _ = Describe("MemoryLocker", func() {
+	var subject *MemoryLocker
+	var ctx context.Context
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		subject = NewMemory()
+		subject.tries = 2
+		subject.expiry = 50 * time.Millisecond
+		subject.retryDelay = 10 * time.Millisecond
+	})
+
+	It("Locks free mutex", func() {
+		Expect(subject.NewMutex("a").Lock(ctx)).To(Succeed())
+	})
+
+	It("Does not lock taken mutex", func() {
+		Expect(subject.NewMutex("a").Lock(ctx)).To(Succeed())
+		Expect(subject.NewMutex("a").Lock(ctx)).To(Equal(ErrLockTaken))
+	})
+
+	It("Locks mutexes with other names independently", func() {
+		Expect(subject.NewMutex("a").Lock(ctx)).To(Succeed())
+		Expect(subject.NewMutex("b").Lock(ctx)).To(Succeed())
+	})
+
+	It("Locks mutex after unlock", func() {
+		m := subject.NewMutex("a")
+		Expect(m.Lock(ctx)).To(Succeed())
+		Expect(m.Unlock()).To(BeTrue())
+
+		Expect(subject.NewMutex("a").Lock(ctx)).To(Succeed())
+	})
+
+	It("Locks mutex after expiry", func() {
+		m := subject.NewMutex("a")
+		Expect(m.Lock(ctx)).To(Succeed())
+
+		time.Sleep(60 * time.Millisecond)
+
+		Expect(subject.NewMutex("a").Lock(ctx)).To(Succeed())
+		Expect(m.Unlock()).To(BeFalse())
+		Expect(m.Extend()).To(BeFalse())
+	})
+
+	It("Keeps mutex locked after extend", func() {
+		m := subject.NewMutex("a")
+		Expect(m.Lock(ctx)).To(Succeed())
+
+		time.Sleep(30 * time.Millisecond)
+		Expect(m.Extend()).To(BeTrue())
+		time.Sleep(30 * time.Millisecond)
+
+		Expect(subject.NewMutex("a").Lock(ctx)).To(Equal(ErrLockTaken))
+	})
+
+	It("Does not unlock mutex held by other", func() {
+		Expect(subject.NewMutex("a").Lock(ctx)).To(Succeed())
+		Expect(subject.NewMutex("a").Unlock()).To(BeFalse())
+	})
+
+	It("Stops retrying once cancelled", func() {
+		Expect(subject.NewMutex("a").Lock(ctx)).To(Succeed())
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		Expect(subject.NewMutex("a").Lock(cancelled)).To(Equal(context.Canceled))
+	})
+
+	It("Sweeps expired locks", func() {
+		Expect(subject.NewMutex("a").Lock(ctx)).To(Succeed())
+
+		time.Sleep(60 * time.Millisecond)
+		Expect(subject.NewMutex("b").Lock(ctx)).To(Succeed())
+
+		Expect(subject.locks).NotTo(HaveKey("a"))
+	})
+})
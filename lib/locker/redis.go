@@ -1,9 +1,6 @@
 package locker
 
 import (
-	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
 	goRedis "github.com/garyburd/redigo/redis"
@@ -26,17 +23,3 @@ func newPool(server string) *goRedis.Pool {
 		},
 	}
 }
-
-func cleanupHook(pool *goRedis.Pool) {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	signal.Notify(c, syscall.SIGTERM)
-	signal.Notify(c, syscall.SIGKILL)
-	go func() {
-		if pool != nil {
-			<-c
-			pool.Close()
-			os.Exit(0)
-		}
-	}()
-}
@@ -0,0 +1,98 @@
+// Package lru keeps least recently used order for in-process caches and evicts from its tail.
+// Cache is bounded by total size of values, which is just number of values when every one has size 1.
+package lru
+
+import "container/list"
+
+// Cache is not safe for concurrent use, callers guard it along with their own state
+type Cache struct {
+	maxSize int64
+	size    int64
+	onEvict func(key string, value interface{})
+
+	ll    *list.List // of *entry, most recently used first
+	index map[string]*list.Element
+}
+
+type entry struct {
+	key   string
+	value interface{}
+	size  int64
+}
+
+// New returns cache bounded by maxSize, unbounded if it is not positive.
+// onEvict is optional, it is called for values evicted to fit the size, but not for removed or replaced ones.
+func New(maxSize int64, onEvict func(key string, value interface{})) *Cache {
+	return &Cache{
+		maxSize: maxSize,
+		onEvict: onEvict,
+		ll:      list.New(),
+		index:   map[string]*list.Element{},
+	}
+}
+
+// Get returns value of key making it the most recently used
+func (c *Cache) Get(key string) (interface{}, bool) {
+	el, ok := c.index[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+
+	return el.Value.(*entry).value, true
+}
+
+// Set adds or replaces value of key making it the most recently used, then evicts values exceeding the size.
+// Value bigger than the whole size is not kept at all, previous value of key is removed then,
+// false is returned so that caller can dispose of it.
+func (c *Cache) Set(key string, value interface{}, size int64) bool {
+	if c.maxSize > 0 && size > c.maxSize {
+		c.Remove(key)
+		return false
+	}
+
+	if el, ok := c.index[key]; ok {
+		e := el.Value.(*entry)
+		c.size += size - e.size
+		e.value, e.size = value, size
+		c.ll.MoveToFront(el)
+	} else {
+		c.index[key] = c.ll.PushFront(&entry{key, value, size})
+		c.size += size
+	}
+
+	for c.maxSize > 0 && c.size > c.maxSize {
+		e := c.remove(c.ll.Back())
+		if c.onEvict != nil {
+			c.onEvict(e.key, e.value)
+		}
+	}
+
+	return true
+}
+
+func (c *Cache) Remove(key string) {
+	if el, ok := c.index[key]; ok {
+		c.remove(el)
+	}
+}
+
+// Size is the total size of values
+func (c *Cache) Size() int64 {
+	return c.size
+}
+
+func (c *Cache) Len() int {
+	return c.ll.Len()
+}
+
+func (c *Cache) remove(el *list.Element) *entry {
+	e := el.Value.(*entry)
+
+	c.ll.Remove(el)
+	delete(c.index, e.key)
+	c.size -= e.size
+
+	return e
+}
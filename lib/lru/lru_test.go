@@ -0,0 +1,111 @@
+package lru
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func Test(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "LRU Suite")
+}
+
+var _ = Describe("Cache", func() {
+	var subject *Cache
+	var evicted []string
+
+	BeforeEach(func() {
+		evicted = nil
+		subject = New(6, func(key string, value interface{}) {
+			evicted = append(evicted, key)
+		})
+	})
+
+	It("Returns set value", func() {
+		subject.Set("a", "aa", 2)
+
+		v, ok := subject.Get("a")
+		Expect(ok).To(BeTrue())
+		Expect(v).To(Equal("aa"))
+	})
+
+	It("Misses unknown key", func() {
+		_, ok := subject.Get("a")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("Replaces value", func() {
+		subject.Set("a", "aa", 2)
+		subject.Set("a", "aaaa", 4)
+
+		v, _ := subject.Get("a")
+		Expect(v).To(Equal("aaaa"))
+		Expect(subject.Size()).To(Equal(int64(4)))
+		Expect(subject.Len()).To(Equal(1))
+	})
+
+	It("Evicts least recently used values", func() {
+		subject.Set("a", "aa", 2)
+		subject.Set("b", "bb", 2)
+		subject.Set("c", "cc", 2)
+		subject.Get("a")
+		subject.Set("d", "dd", 2)
+
+		Expect(evicted).To(Equal([]string{"b"}))
+		Expect(subject.Size()).To(Equal(int64(6)))
+
+		_, ok := subject.Get("b")
+		Expect(ok).To(BeFalse())
+
+		for _, key := range []string{"a", "c", "d"} {
+			_, ok := subject.Get(key)
+			Expect(ok).To(BeTrue())
+		}
+	})
+
+	It("Evicts as many values as needed", func() {
+		subject.Set("a", "aa", 2)
+		subject.Set("b", "bb", 2)
+		subject.Set("c", "ccccc", 5)
+
+		Expect(evicted).To(Equal([]string{"a", "b"}))
+		Expect(subject.Size()).To(Equal(int64(5)))
+	})
+
+	It("Does not keep value bigger than the whole size", func() {
+		subject.Set("a", "aa", 2)
+		subject.Set("b", "bb", 2)
+
+		Expect(subject.Set("a", "aaaaaaa", 7)).To(BeFalse())
+
+		_, ok := subject.Get("a")
+		Expect(ok).To(BeFalse())
+		Expect(evicted).To(BeEmpty())
+		Expect(subject.Size()).To(Equal(int64(2)))
+	})
+
+	It("Forgets removed value", func() {
+		subject.Set("a", "aa", 2)
+		subject.Remove("a")
+
+		_, ok := subject.Get("a")
+		Expect(ok).To(BeFalse())
+		Expect(subject.Size()).To(BeZero())
+		Expect(evicted).To(BeEmpty())
+	})
+
+	Context("When size is not bounded", func() {
+		BeforeEach(func() {
+			subject = New(0, nil)
+		})
+
+		It("Keeps everything", func() {
+			for i := 0; i < 100; i++ {
+				subject.Set(string(rune('a'+i)), i, 100)
+			}
+			Expect(subject.Len()).To(Equal(100))
+		})
+	})
+})
@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "thumbnail"
+
+// phases of the work on thumbnail
+const (
+	PhaseDownload  = "download"
+	PhaseDecode    = "decode"
+	PhaseTransform = "transform"
+	PhaseEncode    = "encode"
+	PhaseStore     = "store"
+)
+
+var (
+	// Requests are labeled by response status and lib.Error type name, none for successful ones
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Thumbnail requests by response status and error type.",
+	}, []string{"status", "error"})
+
+	InFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "in_flight_requests",
+		Help:      "Thumbnail requests being served.",
+	})
+
+	Phases = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "phase_duration_seconds",
+		Help:      "Duration of the work on thumbnail by phase.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"phase"})
+
+	// Cache is labeled by result of store lookup: hit, miss or error
+	Cache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_lookups_total",
+		Help:      "Lookups of transformed images in store by result.",
+	}, []string{"result"})
+
+	// Locks are labeled by result of lock attempt: acquired, contended, cancelled or error
+	Locks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "lock_attempts_total",
+		Help:      "Attempts to lock the work on thumbnail by result.",
+	}, []string{"result"})
+
+	// Awaits are labeled by how waiting for the lock holder ended
+	Awaits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "await_outcomes_total",
+		Help:      "Outcomes of waiting for the lock holder.",
+	}, []string{"outcome"})
+
+	// Bytes are labeled by direction: in for downloaded sources, out for served thumbnails
+	Bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_total",
+		Help:      "Bytes of downloaded sources and served thumbnails.",
+	}, []string{"direction"})
+)
+
+// memory cache stats are read on scrape from the func set by MemoryCache
+var (
+	memoryMu    sync.Mutex
+	memoryStats func() (hits, misses uint64, bytes int64)
+)
+
+// memoryValue reads one of memory cache stats, zero until MemoryCache is called
+func memoryValue(value func(hits, misses uint64, bytes int64) float64) func() float64 {
+	return func() float64 {
+		memoryMu.Lock()
+		stats := memoryStats
+		memoryMu.Unlock()
+
+		if stats == nil {
+			return 0
+		}
+		return value(stats())
+	}
+}
+
+var (
+	MemoryHits = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "memory_cache_hits_total",
+		Help:      "Lookups served by in-memory cache.",
+	}, memoryValue(func(hits, _ uint64, _ int64) float64 { return float64(hits) }))
+
+	MemoryMisses = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "memory_cache_misses_total",
+		Help:      "Lookups passed by in-memory cache to the store.",
+	}, memoryValue(func(_, misses uint64, _ int64) float64 { return float64(misses) }))
+
+	MemoryBytes = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "memory_cache_bytes",
+		Help:      "Size of thumbnails kept in memory.",
+	}, memoryValue(func(_, _ uint64, bytes int64) float64 { return float64(bytes) }))
+)
+
+func init() {
+	prometheus.MustRegister(Requests, InFlight, Phases, Cache, Locks, Awaits, Bytes, MemoryHits, MemoryMisses, MemoryBytes)
+}
+
+// MemoryCache exports stats of the in-memory cache, the latest one wins
+func MemoryCache(stats func() (hits, misses uint64, bytes int64)) {
+	memoryMu.Lock()
+	memoryStats = stats
+	memoryMu.Unlock()
+}
+
+// Since records duration of phase started at start
+func Since(phase string, start time.Time) {
+	Phases.WithLabelValues(phase).Observe(time.Since(start).Seconds())
+}
+
+// Handler exposes metrics to prometheus
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -1,7 +1,16 @@
 package lib
 
+import (
+	"context"
+	"errors"
+)
+
+// ErrLockTaken is returned by Mutex.Lock when someone else holds the lock,
+// other errors mean that locking itself failed
+var ErrLockTaken = errors.New("lock is taken")
+
 type Mutex interface {
-	Lock() error
+	Lock(ctx context.Context) error
 	Unlock() bool
 	Extend() bool
 }
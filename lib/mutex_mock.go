@@ -5,6 +5,7 @@
 package lib
 
 import (
+	context "context"
 	gomock "github.com/golang/mock/gomock"
 	reflect "reflect"
 )
@@ -33,15 +34,15 @@ func (m *MockMutex) EXPECT() *MockMutexMockRecorder {
 }
 
 // Lock mocks base method
-func (m *MockMutex) Lock() error {
-	ret := m.ctrl.Call(m, "Lock")
+func (m *MockMutex) Lock(ctx context.Context) error {
+	ret := m.ctrl.Call(m, "Lock", ctx)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Lock indicates an expected call of Lock
-func (mr *MockMutexMockRecorder) Lock() *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Lock", reflect.TypeOf((*MockMutex)(nil).Lock))
+func (mr *MockMutexMockRecorder) Lock(ctx interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Lock", reflect.TypeOf((*MockMutex)(nil).Lock), ctx)
 }
 
 // Unlock mocks base method
@@ -0,0 +1,58 @@
+package notifier
+
+import (
+	"context"
+	"sync"
+)
+
+// Memory delivers notifications within the process only,
+// which is enough for single instance and tests
+type Memory struct {
+	mu   sync.Mutex
+	subs map[string]map[chan error]struct{}
+}
+
+func NewMemory() *Memory {
+	return &Memory{subs: map[string]map[chan error]struct{}{}}
+}
+
+func (n *Memory) Subscribe(ctx context.Context, key string) (<-chan error, func()) {
+	ch := make(chan error, 1)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.subs[key] == nil {
+		n.subs[key] = map[chan error]struct{}{}
+	}
+	n.subs[key][ch] = struct{}{}
+
+	return ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+
+		delete(n.subs[key], ch)
+		if len(n.subs[key]) == 0 {
+			delete(n.subs, key)
+		}
+	}
+}
+
+func (n *Memory) Publish(ctx context.Context, key string, outcome error) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	deliver(n.subs[key], outcome)
+
+	return nil
+}
+
+// deliver never blocks: subscriber is interested in the first outcome only
+func deliver(subs map[chan error]struct{}, outcome error) {
+	for ch := range subs {
+		select {
+		case ch <- outcome:
+		default:
+		}
+	}
+}
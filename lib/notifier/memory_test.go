@@ -0,0 +1,65 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func Test(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Notifier Suite")
+}
+
+var ctx = context.Background()
+
+var _ = Describe("Memory", func() {
+	var subject *Memory
+
+	BeforeEach(func() {
+		subject = NewMemory()
+	})
+
+	It("Notifies subscribers of the key", func() {
+		a, unsubscribeA := subject.Subscribe(ctx, "key")
+		defer unsubscribeA()
+		b, unsubscribeB := subject.Subscribe(ctx, "key")
+		defer unsubscribeB()
+
+		Expect(subject.Publish(ctx, "key", errors.New("oups"))).To(Succeed())
+
+		Expect(a).To(Receive(MatchError("oups")))
+		Expect(b).To(Receive(MatchError("oups")))
+	})
+
+	It("Does not notify subscribers of other keys", func() {
+		other, unsubscribe := subject.Subscribe(ctx, "other")
+		defer unsubscribe()
+
+		Expect(subject.Publish(ctx, "key", nil)).To(Succeed())
+
+		Expect(other).NotTo(Receive())
+	})
+
+	It("Does not notify after unsubscribe", func() {
+		ch, unsubscribe := subject.Subscribe(ctx, "key")
+		unsubscribe()
+
+		Expect(subject.Publish(ctx, "key", nil)).To(Succeed())
+
+		Expect(ch).NotTo(Receive())
+	})
+
+	It("Does not block on subscriber that is not receiving", func() {
+		ch, unsubscribe := subject.Subscribe(ctx, "key")
+		defer unsubscribe()
+
+		Expect(subject.Publish(ctx, "key", nil)).To(Succeed())
+		Expect(subject.Publish(ctx, "key", nil)).To(Succeed())
+
+		Expect(ch).To(Receive(BeNil()))
+	})
+})
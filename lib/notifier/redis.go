@@ -0,0 +1,231 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Bobochka/thumbnail_service/lib"
+	goRedis "github.com/garyburd/redigo/redis"
+)
+
+var reconnectDelay = time.Second
+
+// Redis delivers notifications through redis pub/sub, so that waiters in all instances are notified.
+// Subscriptions of the process share single connection, which is reestablished when broken.
+// Cancellation is checked before publishing only, as redis calls are short.
+// Close has to be called before the pool is closed, otherwise it keeps reconnecting.
+type Redis struct {
+	pool   *goRedis.Pool
+	prefix string
+
+	mu   sync.Mutex
+	conn *goRedis.PubSubConn // nil while disconnected
+	subs map[string]map[chan error]struct{}
+
+	done    chan struct{}
+	closing sync.Once
+	stopped chan struct{}
+}
+
+// message is published outcome, failure is empty on success
+type message struct {
+	Failure *lib.ErrorMessage `json:"failure,omitempty"`
+}
+
+func NewRedis(pool *goRedis.Pool, prefix string) *Redis {
+	n := &Redis{
+		pool:    pool,
+		prefix:  prefix,
+		subs:    map[string]map[chan error]struct{}{},
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go n.run()
+
+	return n
+}
+
+func (n *Redis) Subscribe(ctx context.Context, key string) (<-chan error, func()) {
+	ch := make(chan error, 1)
+	channel := n.prefix + key
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.subs[channel] == nil {
+		n.subs[channel] = map[chan error]struct{}{}
+
+		// otherwise subscribed on connect
+		if n.conn != nil {
+			if err := n.conn.Subscribe(channel); err != nil {
+				log.Printf("unable to subscribe to redis: %+v\n", err)
+			}
+		}
+	}
+	n.subs[channel][ch] = struct{}{}
+
+	return ch, func() { n.unsubscribe(channel, ch) }
+}
+
+func (n *Redis) Publish(ctx context.Context, key string, outcome error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(encode(outcome))
+	if err != nil {
+		return err
+	}
+
+	conn := n.pool.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("PUBLISH", n.prefix+key, data)
+
+	return err
+}
+
+func (n *Redis) unsubscribe(channel string, ch chan error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.subs[channel], ch)
+	if len(n.subs[channel]) > 0 {
+		return
+	}
+
+	delete(n.subs, channel)
+
+	if n.conn != nil {
+		if err := n.conn.Unsubscribe(channel); err != nil {
+			log.Printf("unable to unsubscribe from redis: %+v\n", err)
+		}
+	}
+}
+
+// Close stops listening and waits for the connection to be released,
+// subscribers are not notified afterwards
+func (n *Redis) Close() error {
+	n.closing.Do(func() { close(n.done) })
+
+	// unsubscribing from everything ends listening
+	n.mu.Lock()
+	if n.conn != nil {
+		if err := n.conn.Unsubscribe(); err != nil {
+			log.Printf("unable to unsubscribe from redis: %+v\n", err)
+		}
+	}
+	n.mu.Unlock()
+
+	<-n.stopped
+
+	return nil
+}
+
+func (n *Redis) run() {
+	defer close(n.stopped)
+
+	for {
+		err := n.listen()
+		if n.closed() {
+			return
+		}
+
+		log.Printf("redis notifier disconnected: %+v\n", err)
+
+		select {
+		case <-n.done:
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+func (n *Redis) closed() bool {
+	select {
+	case <-n.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (n *Redis) listen() error {
+	conn := &goRedis.PubSubConn{Conn: n.pool.Get()}
+	defer conn.Close()
+
+	n.mu.Lock()
+	channels := make([]interface{}, 0, len(n.subs))
+	for channel := range n.subs {
+		channels = append(channels, channel)
+	}
+
+	if len(channels) > 0 {
+		if err := conn.Subscribe(channels...); err != nil {
+			n.mu.Unlock()
+			return err
+		}
+	}
+
+	// otherwise listening would not be ended by Close
+	if n.closed() {
+		n.mu.Unlock()
+		return nil
+	}
+	n.conn = conn
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		n.conn = nil
+		n.mu.Unlock()
+	}()
+
+	for {
+		switch v := conn.Receive().(type) {
+		case goRedis.Message:
+			n.dispatch(v.Channel, v.Data)
+		case goRedis.Subscription:
+			if v.Count == 0 && n.closed() {
+				return nil
+			}
+		case error:
+			return v
+		}
+	}
+}
+
+func (n *Redis) dispatch(channel string, data []byte) {
+	var msg message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Printf("invalid notification %s: %+v\n", data, err)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	deliver(n.subs[channel], decode(msg))
+}
+
+func encode(outcome error) message {
+	if outcome == nil {
+		return message{}
+	}
+
+	failure := lib.NewErrorMessage(outcome)
+
+	return message{Failure: &failure}
+}
+
+func decode(msg message) error {
+	if msg.Failure == nil {
+		return nil
+	}
+
+	return msg.Failure.Err()
+}
@@ -0,0 +1,62 @@
+package notifier
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/Bobochka/thumbnail_service/lib"
+	goRedis "github.com/garyburd/redigo/redis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Redis message", func() {
+	It("Passes success", func() {
+		Expect(decode(encode(nil))).To(BeNil())
+	})
+
+	It("Passes failure", func() {
+		Expect(decode(encode(errors.New("oups")))).To(MatchError("oups"))
+	})
+
+	It("Passes type of lib.Error", func() {
+		err := decode(encode(lib.NewError(errors.New("oups"), lib.UnsupportedContentType)))
+
+		Expect(err).To(BeAssignableToTypeOf(lib.Error{}))
+		Expect(err.(lib.Error).Code()).To(Equal(400))
+		Expect(err).To(MatchError("oups"))
+	})
+})
+
+var _ = Describe("Redis", func() {
+	var delay time.Duration
+	var dials int32
+
+	BeforeEach(func() {
+		delay = reconnectDelay
+		reconnectDelay = time.Millisecond
+		atomic.StoreInt32(&dials, 0)
+	})
+
+	AfterEach(func() {
+		reconnectDelay = delay
+	})
+
+	It("Stops reconnecting once closed", func() {
+		pool := &goRedis.Pool{
+			Dial: func() (goRedis.Conn, error) {
+				atomic.AddInt32(&dials, 1)
+				return nil, errors.New("redis is down")
+			},
+		}
+
+		subject := NewRedis(pool, "prefix:")
+		Eventually(func() int32 { return atomic.LoadInt32(&dials) }).Should(BeNumerically(">", 1))
+
+		Expect(subject.Close()).To(Succeed())
+
+		dialed := atomic.LoadInt32(&dials)
+		Consistently(func() int32 { return atomic.LoadInt32(&dials) }, 50*time.Millisecond).Should(Equal(dialed))
+	})
+})
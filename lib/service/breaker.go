@@ -0,0 +1,48 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker stops calling store for cooldown once threshold consecutive calls failed.
+// After cooldown calls are let through again, and the first failure opens it back.
+// Zero threshold disables it.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+}
+
+func (b *breaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.failures < b.threshold || time.Since(b.openedAt) >= b.cooldown
+}
+
+func (b *breaker) report(err error) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
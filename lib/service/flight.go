@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"sync"
+)
+
+// flight coalesces concurrent calls with the same key within the process:
+// the first call does the work with its context, the rest wait for its result.
+// In case the first call is cancelled, waiters try again with their own contexts.
+type flight struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func newFlight() *flight {
+	return &flight{calls: map[string]*flightCall{}}
+}
+
+func (f *flight) do(ctx context.Context, key string, fn func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	f.mu.Lock()
+	if c, ok := f.calls[key]; ok {
+		f.mu.Unlock()
+
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		cancelled := c.err == context.Canceled || c.err == context.DeadlineExceeded
+		if cancelled && ctx.Err() == nil {
+			return f.do(ctx, key, fn)
+		}
+
+		return c.data, c.err
+	}
+
+	// waiters get ErrPanicked unless fn returns
+	c := &flightCall{done: make(chan struct{}), err: ErrPanicked}
+	f.calls[key] = c
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.calls, key)
+		f.mu.Unlock()
+
+		close(c.done)
+	}()
+
+	c.data, c.err = fn(ctx)
+
+	return c.data, c.err
+}
@@ -5,6 +5,7 @@
 package service
 
 import (
+	context "context"
 	lib "github.com/Bobochka/thumbnail_service/lib"
 	gomock "github.com/golang/mock/gomock"
 	reflect "reflect"
@@ -34,27 +35,29 @@ func (m *MockStore) EXPECT() *MockStoreMockRecorder {
 }
 
 // Get mocks base method
-func (m *MockStore) Get(key string) []byte {
-	ret := m.ctrl.Call(m, "Get", key)
+func (m *MockStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	ret := m.ctrl.Call(m, "Get", ctx, key)
 	ret0, _ := ret[0].([]byte)
-	return ret0
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
 }
 
 // Get indicates an expected call of Get
-func (mr *MockStoreMockRecorder) Get(key interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockStore)(nil).Get), key)
+func (mr *MockStoreMockRecorder) Get(ctx, key interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockStore)(nil).Get), ctx, key)
 }
 
 // Set mocks base method
-func (m *MockStore) Set(key string, data []byte) error {
-	ret := m.ctrl.Call(m, "Set", key, data)
+func (m *MockStore) Set(ctx context.Context, key string, data []byte) error {
+	ret := m.ctrl.Call(m, "Set", ctx, key, data)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Set indicates an expected call of Set
-func (mr *MockStoreMockRecorder) Set(key, data interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Set", reflect.TypeOf((*MockStore)(nil).Set), key, data)
+func (mr *MockStoreMockRecorder) Set(ctx, key, data interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Set", reflect.TypeOf((*MockStore)(nil).Set), ctx, key, data)
 }
 
 // MockTransformation is a mock of Transformation interface
@@ -92,17 +95,29 @@ func (mr *MockTransformationMockRecorder) Fingerprint(data interface{}) *gomock.
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Fingerprint", reflect.TypeOf((*MockTransformation)(nil).Fingerprint), data)
 }
 
+// Params mocks base method
+func (m *MockTransformation) Params() string {
+	ret := m.ctrl.Call(m, "Params")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// Params indicates an expected call of Params
+func (mr *MockTransformationMockRecorder) Params() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Params", reflect.TypeOf((*MockTransformation)(nil).Params))
+}
+
 // Perform mocks base method
-func (m *MockTransformation) Perform(data []byte) ([]byte, error) {
-	ret := m.ctrl.Call(m, "Perform", data)
+func (m *MockTransformation) Perform(ctx context.Context, data []byte) ([]byte, error) {
+	ret := m.ctrl.Call(m, "Perform", ctx, data)
 	ret0, _ := ret[0].([]byte)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Perform indicates an expected call of Perform
-func (mr *MockTransformationMockRecorder) Perform(data interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Perform", reflect.TypeOf((*MockTransformation)(nil).Perform), data)
+func (mr *MockTransformationMockRecorder) Perform(ctx, data interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Perform", reflect.TypeOf((*MockTransformation)(nil).Perform), ctx, data)
 }
 
 // MockDownloader is a mock of Downloader interface
@@ -129,16 +144,77 @@ func (m *MockDownloader) EXPECT() *MockDownloaderMockRecorder {
 }
 
 // Download mocks base method
-func (m *MockDownloader) Download(url string) ([]byte, error) {
-	ret := m.ctrl.Call(m, "Download", url)
+func (m *MockDownloader) Download(ctx context.Context, url string) ([]byte, lib.Validators, error) {
+	ret := m.ctrl.Call(m, "Download", ctx, url)
 	ret0, _ := ret[0].([]byte)
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
+	ret1, _ := ret[1].(lib.Validators)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
 }
 
 // Download indicates an expected call of Download
-func (mr *MockDownloaderMockRecorder) Download(url interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Download", reflect.TypeOf((*MockDownloader)(nil).Download), url)
+func (mr *MockDownloaderMockRecorder) Download(ctx, url interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Download", reflect.TypeOf((*MockDownloader)(nil).Download), ctx, url)
+}
+
+// DownloadIfModified mocks base method
+func (m *MockDownloader) DownloadIfModified(ctx context.Context, url string) ([]byte, lib.Validators, error) {
+	ret := m.ctrl.Call(m, "DownloadIfModified", ctx, url)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(lib.Validators)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// DownloadIfModified indicates an expected call of DownloadIfModified
+func (mr *MockDownloaderMockRecorder) DownloadIfModified(ctx, url interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DownloadIfModified", reflect.TypeOf((*MockDownloader)(nil).DownloadIfModified), ctx, url)
+}
+
+// MockIndex is a mock of Index interface
+type MockIndex struct {
+	ctrl     *gomock.Controller
+	recorder *MockIndexMockRecorder
+}
+
+// MockIndexMockRecorder is the mock recorder for MockIndex
+type MockIndexMockRecorder struct {
+	mock *MockIndex
+}
+
+// NewMockIndex creates a new mock instance
+func NewMockIndex(ctrl *gomock.Controller) *MockIndex {
+	mock := &MockIndex{ctrl: ctrl}
+	mock.recorder = &MockIndexMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockIndex) EXPECT() *MockIndexMockRecorder {
+	return m.recorder
+}
+
+// Get mocks base method
+func (m *MockIndex) Get(ctx context.Context, key string) (IndexEntry, bool) {
+	ret := m.ctrl.Call(m, "Get", ctx, key)
+	ret0, _ := ret[0].(IndexEntry)
+	ret1, _ := ret[1].(bool)
+	return ret0, ret1
+}
+
+// Get indicates an expected call of Get
+func (mr *MockIndexMockRecorder) Get(ctx, key interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockIndex)(nil).Get), ctx, key)
+}
+
+// Set mocks base method
+func (m *MockIndex) Set(ctx context.Context, key string, entry IndexEntry) {
+	m.ctrl.Call(m, "Set", ctx, key, entry)
+}
+
+// Set indicates an expected call of Set
+func (mr *MockIndexMockRecorder) Set(ctx, key, entry interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Set", reflect.TypeOf((*MockIndex)(nil).Set), ctx, key, entry)
 }
 
 // MockLocker is a mock of Locker interface
@@ -175,3 +251,145 @@ func (m *MockLocker) NewMutex(name string) lib.Mutex {
 func (mr *MockLockerMockRecorder) NewMutex(name interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewMutex", reflect.TypeOf((*MockLocker)(nil).NewMutex), name)
 }
+
+// MockNotifier is a mock of Notifier interface
+type MockNotifier struct {
+	ctrl     *gomock.Controller
+	recorder *MockNotifierMockRecorder
+}
+
+// MockNotifierMockRecorder is the mock recorder for MockNotifier
+type MockNotifierMockRecorder struct {
+	mock *MockNotifier
+}
+
+// NewMockNotifier creates a new mock instance
+func NewMockNotifier(ctrl *gomock.Controller) *MockNotifier {
+	mock := &MockNotifier{ctrl: ctrl}
+	mock.recorder = &MockNotifierMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockNotifier) EXPECT() *MockNotifierMockRecorder {
+	return m.recorder
+}
+
+// Subscribe mocks base method
+func (m *MockNotifier) Subscribe(ctx context.Context, key string) (<-chan error, func()) {
+	ret := m.ctrl.Call(m, "Subscribe", ctx, key)
+	ret0, _ := ret[0].(<-chan error)
+	ret1, _ := ret[1].(func())
+	return ret0, ret1
+}
+
+// Subscribe indicates an expected call of Subscribe
+func (mr *MockNotifierMockRecorder) Subscribe(ctx, key interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Subscribe", reflect.TypeOf((*MockNotifier)(nil).Subscribe), ctx, key)
+}
+
+// Publish mocks base method
+func (m *MockNotifier) Publish(ctx context.Context, key string, outcome error) error {
+	ret := m.ctrl.Call(m, "Publish", ctx, key, outcome)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Publish indicates an expected call of Publish
+func (mr *MockNotifierMockRecorder) Publish(ctx, key, outcome interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Publish", reflect.TypeOf((*MockNotifier)(nil).Publish), ctx, key, outcome)
+}
+
+// MockFailures is a mock of Failures interface
+type MockFailures struct {
+	ctrl     *gomock.Controller
+	recorder *MockFailuresMockRecorder
+}
+
+// MockFailuresMockRecorder is the mock recorder for MockFailures
+type MockFailuresMockRecorder struct {
+	mock *MockFailures
+}
+
+// NewMockFailures creates a new mock instance
+func NewMockFailures(ctrl *gomock.Controller) *MockFailures {
+	mock := &MockFailures{ctrl: ctrl}
+	mock.recorder = &MockFailuresMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockFailures) EXPECT() *MockFailuresMockRecorder {
+	return m.recorder
+}
+
+// Get mocks base method
+func (m *MockFailures) Get(ctx context.Context, key string) (lib.Error, bool) {
+	ret := m.ctrl.Call(m, "Get", ctx, key)
+	ret0, _ := ret[0].(lib.Error)
+	ret1, _ := ret[1].(bool)
+	return ret0, ret1
+}
+
+// Get indicates an expected call of Get
+func (mr *MockFailuresMockRecorder) Get(ctx, key interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockFailures)(nil).Get), ctx, key)
+}
+
+// Set mocks base method
+func (m *MockFailures) Set(ctx context.Context, key string, err lib.Error) {
+	m.ctrl.Call(m, "Set", ctx, key, err)
+}
+
+// Set indicates an expected call of Set
+func (mr *MockFailuresMockRecorder) Set(ctx, key, err interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Set", reflect.TypeOf((*MockFailures)(nil).Set), ctx, key, err)
+}
+
+// MockJobs is a mock of Jobs interface
+type MockJobs struct {
+	ctrl     *gomock.Controller
+	recorder *MockJobsMockRecorder
+}
+
+// MockJobsMockRecorder is the mock recorder for MockJobs
+type MockJobsMockRecorder struct {
+	mock *MockJobs
+}
+
+// NewMockJobs creates a new mock instance
+func NewMockJobs(ctrl *gomock.Controller) *MockJobs {
+	mock := &MockJobs{ctrl: ctrl}
+	mock.recorder = &MockJobsMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockJobs) EXPECT() *MockJobsMockRecorder {
+	return m.recorder
+}
+
+// Get mocks base method
+func (m *MockJobs) Get(ctx context.Context, key string) (lib.JobState, bool) {
+	ret := m.ctrl.Call(m, "Get", ctx, key)
+	ret0, _ := ret[0].(lib.JobState)
+	ret1, _ := ret[1].(bool)
+	return ret0, ret1
+}
+
+// Get indicates an expected call of Get
+func (mr *MockJobsMockRecorder) Get(ctx, key interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockJobs)(nil).Get), ctx, key)
+}
+
+// Set mocks base method
+func (m *MockJobs) Set(ctx context.Context, key string, state lib.JobState) error {
+	ret := m.ctrl.Call(m, "Set", ctx, key, state)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Set indicates an expected call of Set
+func (mr *MockJobsMockRecorder) Set(ctx, key, state interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Set", reflect.TypeOf((*MockJobs)(nil).Set), ctx, key, state)
+}
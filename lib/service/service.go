@@ -1,106 +1,457 @@
 package service
 
 import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"sync"
 	"time"
 
 	"log"
 
 	"github.com/Bobochka/thumbnail_service/lib"
+	"github.com/Bobochka/thumbnail_service/lib/metrics"
 	"github.com/go-errors/errors"
-	"github.com/paulbellamy/ratecounter"
 )
 
+// Store reports whether the key was found,
+// an error means store was not able to tell.
+// Set returns ErrTooLarge for data the store does not keep because of its size.
 type Store interface {
-	Get(key string) []byte
-	Set(key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, data []byte) error
 }
 
 type Transformation interface {
 	Fingerprint(data []byte) string
-	Perform(data []byte) ([]byte, error)
+	// Params identifies transformation regardless of the data it is applied to
+	Params() string
+	Perform(ctx context.Context, data []byte) ([]byte, error)
 }
 
 type Downloader interface {
-	Download(url string) ([]byte, error)
+	Download(ctx context.Context, url string) ([]byte, lib.Validators, error)
+	// DownloadIfModified returns lib.ErrSourceNotModified along with validators
+	// in case source is not modified since the previous download
+	DownloadIfModified(ctx context.Context, url string) ([]byte, lib.Validators, error)
+}
+
+// Index remembers fingerprints of transformations of urls,
+// so that cached results can be served without downloading the source.
+type Index interface {
+	Get(ctx context.Context, key string) (IndexEntry, bool)
+	Set(ctx context.Context, key string, entry IndexEntry)
+}
+
+type IndexEntry struct {
+	Fingerprint string
+	// Validators of the source the fingerprint was computed from
+	Validators lib.Validators
+	// Entry is trusted without revalidation until Expires
+	Expires time.Time
 }
 
 type Locker interface {
 	NewMutex(name string) lib.Mutex
 }
 
+// Notifier delivers outcome of the work on key from the performer to waiters, possibly in other processes
+type Notifier interface {
+	// Subscribe returns channel receiving nil once result is stored, or error performer failed with.
+	// Returned func cancels subscription.
+	Subscribe(ctx context.Context, key string) (<-chan error, func())
+	Publish(ctx context.Context, key string, outcome error) error
+}
+
+// Failures remembers recent failures that are bound to repeat,
+// so that broken sources are neither downloaded nor decoded again for a while
+type Failures interface {
+	Get(ctx context.Context, key string) (lib.Error, bool)
+	Set(ctx context.Context, key string, err lib.Error)
+}
+
+// Jobs keeps state of the work on key alongside the lock, so that requests
+// arriving while or shortly after it is performed learn its outcome even if notification is missed.
+// As well as notifications, states are recorded regardless of cancellation.
+type Jobs interface {
+	// Get reports whether state is known
+	Get(ctx context.Context, key string) (lib.JobState, bool)
+	Set(ctx context.Context, key string, state lib.JobState) error
+}
+
+// StorePolicy defines how Perform reacts to store failures
+type StorePolicy int
+
+const (
+	// StoreBypass performs transformation as if result was not stored
+	StoreBypass StorePolicy = iota
+	// StoreFailFast responds with error straight away
+	StoreFailFast
+)
+
 type Config struct {
 	Store      Store
 	Downloader Downloader
 	Locker     Locker
+	Notifier   Notifier
+	Jobs       Jobs
+
+	// Index is optional, without it source is downloaded on every request
+	Index    Index
+	IndexTTL time.Duration
+
+	// Failures are optional, without them failed sources are retried on every request
+	Failures Failures
+
+	StorePolicy StorePolicy
+	// after BreakerThreshold consecutive store failures store is not called for BreakerCooldown,
+	// zero threshold disables breaker
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
 }
 
 type Service struct {
-	store      Store
-	downloader Downloader
-	locker     Locker
-	counter    *ratecounter.AvgRateCounter
+	store       Store
+	storePolicy StorePolicy
+	breaker     *breaker
+	downloader  Downloader
+	locker      Locker
+	notifier    Notifier
+	jobs        Jobs
+	index       Index
+	indexTTL    time.Duration
+	failures    Failures
+	flight      *flight
+
+	// in-flight Perform calls, which are cancelled once abort is closed
+	mu       sync.Mutex
+	closing  bool
+	inflight sync.WaitGroup
+	abort    chan struct{}
+	aborting sync.Once
 }
 
 func New(config *Config) *Service {
 	return &Service{
-		store:      config.Store,
-		downloader: config.Downloader,
-		locker:     config.Locker,
-		counter:    ratecounter.NewAvgRateCounter(60 * time.Second),
+		store:       config.Store,
+		storePolicy: config.StorePolicy,
+		breaker:     &breaker{threshold: config.BreakerThreshold, cooldown: config.BreakerCooldown},
+		downloader:  config.Downloader,
+		locker:      config.Locker,
+		notifier:    config.Notifier,
+		jobs:        config.Jobs,
+		index:       config.Index,
+		indexTTL:    config.IndexTTL,
+		failures:    config.Failures,
+		flight:      newFlight(),
+		abort:       make(chan struct{}),
 	}
 }
 
 var (
-	StorePollTries           = 3
-	MaxLoops                 = 2
-	DefaultPollSleepInterval = 200 * time.Millisecond
-	ErrOnStore               = errors.New("unable to store processed data")
+	MaxLoops = 2
+	// AwaitTimeout limits waiting for concurrent performer, matches lock expiry
+	AwaitTimeout   = 5 * time.Second
+	ErrOnStore     = errors.New("unable to store processed data")
+	ErrTooLarge    = errors.New("data is too large to store")
+	ErrTransient   = errors.New("concurrent performer failed in a way that is worth retrying")
+	ErrNotModified = errors.New("result is not modified")
+	ErrBreakerOpen = errors.New("store is not called after repeated failures")
+	ErrPanicked    = errors.New("performer panicked")
+	ErrShutdown    = errors.New("service is shut down")
 )
 
-func (s *Service) Perform(url string, t Transformation) ([]byte, error) {
-	imgBytes, err := s.downloader.Download(url)
+// Perform downloads image from url and applies transformation to it.
+// Returned key identifies the result, so it is suitable for ETag.
+// In case notModified reports the key as known to the caller,
+// ErrNotModified is returned instead of the data.
+// Once ctx is done, the work is abandoned and ctx error is returned.
+func (s *Service) Perform(ctx context.Context, url string, t Transformation, notModified func(key string) bool) ([]byte, string, error) {
+	if !s.enter() {
+		return nil, "", lib.NewError(ErrShutdown, lib.ShuttingDown)
+	}
+	defer s.inflight.Done()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-s.abort:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	data, key, err := s.process(ctx, url, t, notModified)
+	if err != nil && ctx.Err() != nil && s.aborted() {
+		err = lib.NewError(ErrShutdown, lib.ShuttingDown)
+	}
+
+	return data, key, err
+}
+
+// Shutdown stops accepting new work and waits for in-flight Perform calls to finish.
+// Once ctx is done, they are cancelled, so that their mutexes are released and waiters notified,
+// ctx error is returned after they return.
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.aborting.Do(func() { close(s.abort) })
+	<-drained
+
+	return ctx.Err()
+}
+
+func (s *Service) enter() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return false
+	}
+
+	s.inflight.Add(1)
+
+	return true
+}
+
+func (s *Service) aborted() bool {
+	select {
+	case <-s.abort:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Service) process(ctx context.Context, url string, t Transformation, notModified func(key string) bool) ([]byte, string, error) {
+	if err := s.failed(ctx, urlFailureKey(url)); err != nil {
+		return nil, "", err
+	}
+
+	indexKey := url + " " + t.Params()
+
+	key, imgBytes, err := s.resolve(ctx, url, indexKey, t)
 	if err != nil {
-		return nil, err
+		s.fail(ctx, urlFailureKey(url), err)
+		return nil, "", err
+	}
+
+	if notModified != nil && notModified(key) {
+		return nil, key, ErrNotModified
 	}
 
-	key := t.Fingerprint(imgBytes)
+	stored, found, storeErr := s.storeGet(ctx, key)
+
+	if ctx.Err() != nil {
+		return nil, key, ctx.Err()
+	}
+
+	switch {
+	case storeErr != nil:
+		metrics.Cache.WithLabelValues("error").Inc()
+	case found:
+		metrics.Cache.WithLabelValues("hit").Inc()
+	default:
+		metrics.Cache.WithLabelValues("miss").Inc()
+	}
+
+	if storeErr != nil && s.storePolicy == StoreFailFast {
+		return nil, key, lib.NewError(storeErr, lib.StoreUnavailable)
+	}
+
+	if storeErr == nil && found {
+		return stored, key, nil
+	}
+
+	if imgBytes == nil {
+		// index outlived stored data
+		key, imgBytes, err = s.download(ctx, url, indexKey, t)
+		if err != nil {
+			s.fail(ctx, urlFailureKey(url), err)
+			return nil, "", err
+		}
+	}
+
+	// url keeps pointing at the source that can't be transformed,
+	// so its failure is remembered for the url as well to skip downloading it next time
+	if err := s.failed(ctx, sourceFailureKey(imgBytes)); err != nil {
+		s.fail(ctx, urlFailureKey(url), err)
+		return nil, key, err
+	}
+
+	if storeErr != nil {
+		// there is no point in coordinating through the store that is down
+		log.Println("error reading data from store: ", storeErr)
+		data, err := s.perform(ctx, key, imgBytes, t)
+		if err == ErrOnStore {
+			err = nil
+		}
+		if err != nil {
+			s.fail(ctx, urlFailureKey(url), err)
+		}
+		return data, key, err
+	}
+
+	// identical requests in the process wait for the one doing the work,
+	// locker is left to coordinate with other processes
+	data, err := s.flight.do(ctx, key, func(ctx context.Context) ([]byte, error) {
+		return s.syncedPerform(ctx, key, imgBytes, t, 0)
+	})
+	if err != nil {
+		s.fail(ctx, urlFailureKey(url), err)
+	}
+
+	return data, key, err
+}
+
+// resolve returns fingerprint of the source at url.
+// Fingerprint known to the index is used without downloading the source,
+// expired one is revalidated with conditional download.
+// Returned data is nil unless the source was downloaded.
+func (s *Service) resolve(ctx context.Context, url, indexKey string, t Transformation) (string, []byte, error) {
+	if s.index == nil {
+		return s.download(ctx, url, indexKey, t)
+	}
+
+	entry, ok := s.index.Get(ctx, indexKey)
+	if !ok {
+		return s.download(ctx, url, indexKey, t)
+	}
+
+	if time.Now().Before(entry.Expires) {
+		return entry.Fingerprint, nil, nil
+	}
+
+	// nothing to revalidate with
+	if entry.Validators.Empty() {
+		return s.download(ctx, url, indexKey, t)
+	}
+
+	start := time.Now()
+	data, validators, err := s.downloader.DownloadIfModified(ctx, url)
+	metrics.Since(metrics.PhaseDownload, start)
+	metrics.Bytes.WithLabelValues("in").Add(float64(len(data)))
+
+	if err == lib.ErrSourceNotModified {
+		if validators.Match(entry.Validators) {
+			s.remember(ctx, indexKey, entry.Fingerprint, validators)
+			return entry.Fingerprint, nil, nil
+		}
+
+		// downloader revalidated other version of the source than the indexed one
+		return s.download(ctx, url, indexKey, t)
+	}
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	key := t.Fingerprint(data)
+	s.remember(ctx, indexKey, key, validators)
+
+	return key, data, nil
+}
+
+func (s *Service) download(ctx context.Context, url, indexKey string, t Transformation) (string, []byte, error) {
+	start := time.Now()
+	data, validators, err := s.downloader.Download(ctx, url)
+	metrics.Since(metrics.PhaseDownload, start)
+	metrics.Bytes.WithLabelValues("in").Add(float64(len(data)))
+	if err != nil {
+		return "", nil, err
+	}
+
+	key := t.Fingerprint(data)
+	s.remember(ctx, indexKey, key, validators)
+
+	return key, data, nil
+}
 
-	if stored := s.store.Get(key); len(stored) > 0 {
-		return stored, nil
+func (s *Service) remember(ctx context.Context, indexKey, key string, validators lib.Validators) {
+	if s.index == nil {
+		return
 	}
 
-	return s.syncedPerform(key, imgBytes, t, 0)
+	s.index.Set(ctx, indexKey, IndexEntry{
+		Fingerprint: key,
+		Validators:  validators,
+		Expires:     time.Now().Add(s.indexTTL),
+	})
 }
 
-func (s *Service) syncedPerform(key string, imgBytes []byte, t Transformation, attempt int) ([]byte, error) {
+func (s *Service) syncedPerform(ctx context.Context, key string, imgBytes []byte, t Transformation, attempt int) ([]byte, error) {
+	// subscribe before trying the lock, so that outcome of the holder's work is not missed
+	outcomes, unsubscribe := s.notifier.Subscribe(ctx, key)
+	defer unsubscribe()
+
+	// recent attempt failed the same way this one would
+	if err := s.jobFailure(ctx, key); err != nil {
+		return nil, err
+	}
+
 	m := s.locker.NewMutex(key)
-	isLocked := m.Lock() == nil
+	lockErr := m.Lock(ctx)
+	isLocked := lockErr == nil
+
+	metrics.Locks.WithLabelValues(lockResult(ctx, lockErr)).Inc()
+
+	if isLocked {
+		s.setJob(ctx, key, lib.JobState{Status: lib.JobPending})
+	}
 
 	defer func() {
 		if r := recover(); r != nil {
 			defer m.Unlock()
+			if isLocked {
+				s.finish(key, ErrPanicked)
+			}
 			panic(r)
 		}
 	}()
 
 	if !isLocked {
-		value := s.pollStoredValue(key)
+		value, err := s.awaitStoredValue(ctx, key, outcomes)
+
+		// holder failed the same way this one would
+		if _, ok := err.(lib.Error); ok {
+			return nil, err
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 
 		if len(value) > 0 {
 			return value, nil
 		} else {
 			if attempt < MaxLoops-1 {
-				return s.syncedPerform(key, imgBytes, t, attempt+1)
+				return s.syncedPerform(ctx, key, imgBytes, t, attempt+1)
 			}
 		}
 	}
 
-	data, err := s.instrumentedPerform(key, imgBytes, t)
+	data, err := s.perform(ctx, key, imgBytes, t)
 
 	// Just unlocking the lock after the job is done, will result in stampede:
 	// if 2 goroutines are performing same request,
 	// one can finish the the job and release the mutex,
-	// yet another that already checked store on lines 66:68 will take mutex
+	// yet another that already checked store in Perform will take mutex
 	// and perform the job again which is unwanted.
 	//
 	// In case there's no error (meaning data was saved to store successfully),
@@ -114,9 +465,9 @@ func (s *Service) syncedPerform(key string, imgBytes []byte, t Transformation, a
 	//
 	// if panic will happen during execution, just unlock should work fine.
 	//
-	// Although this solution is not exactly fault tolerant, if process will crash in the middle of operation,
-	// next process (because it won't acquire mutex) will spend at max (3 * avg (transform + store) time) on store polling
-	// and then the state will be ok. During the burst, `processed only once` rule might be violated as well.
+	// Either way the outcome is recorded as job state and waiters are notified about it.
+	// If process will crash in the middle of operation, waiters won't be notified
+	// and will wait for AwaitTimeout, after which the lock expires.
 
 	if isLocked {
 		if err == nil {
@@ -124,6 +475,7 @@ func (s *Service) syncedPerform(key string, imgBytes []byte, t Transformation, a
 		} else {
 			m.Unlock()
 		}
+		s.finish(key, err)
 	}
 
 	// swallow store error
@@ -134,51 +486,233 @@ func (s *Service) syncedPerform(key string, imgBytes []byte, t Transformation, a
 	return data, err
 }
 
-func (s *Service) instrumentedPerform(key string, data []byte, t Transformation) ([]byte, error) {
-	start := time.Now()
+func (s *Service) perform(ctx context.Context, key string, data []byte, t Transformation) ([]byte, error) {
+	res, err := t.Perform(ctx, data)
+	if err != nil {
+		s.fail(ctx, sourceFailureKey(data), err)
+		return []byte{}, err
+	}
+
+	// result that is too large to store is not shared with waiters either,
+	// they are told to perform it themselves
+	err = s.storeSet(ctx, key, res)
+	if err != nil {
+		if err != ErrTooLarge {
+			log.Println("error writing data to store: ", err)
+		}
+		return res, ErrOnStore
+	}
+
+	return res, nil
+}
+
+// results of lock attempt
+const (
+	lockAcquired  = "acquired"
+	lockContended = "contended"
+	lockCancelled = "cancelled"
+	lockError     = "error"
+)
 
-	data, err := s.perform(key, data, t)
-	if err == nil {
-		s.counter.Incr(time.Since(start).Nanoseconds())
+func lockResult(ctx context.Context, err error) string {
+	switch {
+	case err == nil:
+		return lockAcquired
+	case err == lib.ErrLockTaken:
+		return lockContended
+	case ctx.Err() != nil:
+		return lockCancelled
 	}
+	return lockError
+}
+
+// awaitStoredValue waits for the lock holder to finish the work.
+// Error is returned in case holder failed, nil data means waiter should try itself.
+func (s *Service) awaitStoredValue(ctx context.Context, key string, outcomes <-chan error) ([]byte, error) {
+	data, outcome, err := s.await(ctx, key, outcomes)
+	metrics.Awaits.WithLabelValues(outcome).Inc()
 
 	return data, err
 }
 
-func (s *Service) perform(key string, data []byte, t Transformation) ([]byte, error) {
-	res, err := t.Perform(data)
-	if err != nil {
-		return []byte{}, err
+// outcomes of waiting for the lock holder
+const (
+	awaitStored    = "stored"
+	awaitFailed    = "failed"
+	awaitRetry     = "retry"
+	awaitTimeout   = "timeout"
+	awaitCancelled = "cancelled"
+)
+
+func (s *Service) await(ctx context.Context, key string, outcomes <-chan error) ([]byte, string, error) {
+	// holder might have finished before subscription
+	if err := s.jobFailure(ctx, key); err != nil {
+		return nil, awaitFailed, err
 	}
 
-	err = s.store.Set(key, res)
+	stored, found, err := s.storeGet(ctx, key)
 	if err != nil {
-		log.Println("error writing data to store: ", err)
-		return res, ErrOnStore
+		return nil, awaitRetry, nil
 	}
 
-	return res, nil
+	if found {
+		return stored, awaitStored, nil
+	}
+
+	select {
+	case err := <-outcomes:
+		if _, ok := err.(lib.Error); ok {
+			return nil, awaitFailed, err
+		}
+		if err != nil {
+			return nil, awaitRetry, err
+		}
+	case <-time.After(AwaitTimeout):
+		// notification might have been lost
+		if err := s.jobFailure(ctx, key); err != nil {
+			return nil, awaitFailed, err
+		}
+		return nil, awaitTimeout, nil
+	case <-ctx.Done():
+		return nil, awaitCancelled, ctx.Err()
+	}
+
+	stored, found, err = s.storeGet(ctx, key)
+	if err != nil || !found {
+		return nil, awaitRetry, nil
+	}
+
+	return stored, awaitStored, nil
 }
 
-func (s *Service) pollStoredValue(key string) []byte {
-	for i := 0; i < StorePollTries; i++ {
-		// sleep half of avg execution time each round,
-		// so there will be good chance that concurrent performer is done
-		time.Sleep(s.pollSleepInterval())
+// failed returns failure remembered for key
+func (s *Service) failed(ctx context.Context, key string) error {
+	if s.failures == nil {
+		return nil
+	}
 
-		if stored := s.store.Get(key); len(stored) > 0 {
-			return stored
-		}
+	if err, ok := s.failures.Get(ctx, key); ok {
+		return err
 	}
 
 	return nil
 }
 
-func (s *Service) pollSleepInterval() time.Duration {
-	cnt := s.counter.Hits()
-	if cnt == 0 {
-		return DefaultPollSleepInterval
+// fail remembers failures that are bound to repeat,
+// transient ones like timeouts or origin outages are not
+func (s *Service) fail(ctx context.Context, key string, err error) {
+	if s.failures == nil {
+		return
+	}
+
+	if e, ok := err.(lib.Error); ok && isPermanent(e) {
+		s.failures.Set(ctx, key, e)
+	}
+}
+
+func urlFailureKey(url string) string {
+	return "url " + url
+}
+
+// sourceFailureKey identifies the source regardless of url and transformation
+func sourceFailureKey(data []byte) string {
+	return fmt.Sprintf("source %x", sha1.Sum(data))
+}
+
+// isPermanent reports whether the source is missing or is not fit for transformations
+func isPermanent(e lib.Error) bool {
+	switch e.Type() {
+	case lib.SourceNotFound, lib.UnsupportedContentType, lib.SourceTooLarge, lib.ImageTooLarge:
+		return true
+	default:
+		return false
+	}
+}
+
+// finish records outcome of the holder's work and notifies waiters about it,
+// which is done even if the holder was cancelled, so that waiters don't have to wait for the lock to expire.
+// Waiters fail the same way only if the failure is bound to repeat, otherwise they retry the lock.
+func (s *Service) finish(key string, outcome error) {
+	ctx := context.Background()
+
+	if e, ok := outcome.(lib.Error); ok && !isPermanent(e) {
+		outcome = ErrTransient
+	}
+
+	state := lib.JobState{Status: lib.JobDone}
+	if outcome != nil {
+		state = lib.JobState{Status: lib.JobFailed, Err: outcome}
+	}
+	s.setJob(ctx, key, state)
+
+	s.notify(ctx, key, outcome)
+}
+
+func (s *Service) setJob(ctx context.Context, key string, state lib.JobState) {
+	err := s.jobs.Set(ctx, key, state)
+	if err != nil {
+		log.Println("error recording job state: ", err)
+	}
+}
+
+// jobFailure returns lib.Error recent job on key failed with,
+// other failures are transient and worth retrying
+func (s *Service) jobFailure(ctx context.Context, key string) error {
+	state, ok := s.jobs.Get(ctx, key)
+	if !ok || state.Status != lib.JobFailed {
+		return nil
+	}
+
+	if _, ok := state.Err.(lib.Error); ok {
+		return state.Err
+	}
+
+	return nil
+}
+
+func (s *Service) notify(ctx context.Context, key string, outcome error) {
+	err := s.notifier.Publish(ctx, key, outcome)
+	if err != nil {
+		log.Println("error notifying waiters: ", err)
+	}
+}
+
+func (s *Service) storeGet(ctx context.Context, key string) ([]byte, bool, error) {
+	if !s.breaker.allow() {
+		return nil, false, ErrBreakerOpen
+	}
+
+	start := time.Now()
+	data, found, err := s.store.Get(ctx, key)
+	metrics.Since(metrics.PhaseStore, start)
+	s.report(ctx, err)
+
+	return data, found, err
+}
+
+func (s *Service) storeSet(ctx context.Context, key string, data []byte) error {
+	if !s.breaker.allow() {
+		return ErrBreakerOpen
+	}
+
+	start := time.Now()
+	err := s.store.Set(ctx, key, data)
+	metrics.Since(metrics.PhaseStore, start)
+	s.report(ctx, err)
+
+	return err
+}
+
+// report tells breaker about store failures, cancelled calls are not failures of the store,
+// neither is refusing data that is too large
+func (s *Service) report(ctx context.Context, err error) {
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+
+	if err == ErrTooLarge {
+		err = nil
 	}
 
-	return time.Duration(s.counter.Rate() / 2)
+	s.breaker.report(err)
 }
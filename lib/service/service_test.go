@@ -1,12 +1,16 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"testing"
 
 	"time"
 
 	"github.com/Bobochka/thumbnail_service/lib"
+	"github.com/Bobochka/thumbnail_service/lib/failures"
+	lockers "github.com/Bobochka/thumbnail_service/lib/locker"
+	"github.com/Bobochka/thumbnail_service/lib/notifier"
 	"github.com/golang/mock/gomock"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -28,6 +32,12 @@ var _ = Describe("Service", func() {
 	var store *MockStore
 	var downloader *MockDownloader
 	var locker *MockLocker
+	var notifications *notifier.Memory
+	var jobs *lockers.MemoryJobs
+	var storePolicy StorePolicy
+	var index Index
+	var ctx context.Context
+	var negative Failures
 
 	var storeGetCalls []*gomock.Call
 	var lockerNewMutexCalls []*gomock.Call
@@ -46,7 +56,13 @@ var _ = Describe("Service", func() {
 		downloader = NewMockDownloader(mockCtrl)
 		locker = NewMockLocker(mockCtrl)
 
-		DefaultPollSleepInterval = time.Millisecond
+		notifications = notifier.NewMemory()
+		jobs = lockers.NewMemoryJobs()
+		AwaitTimeout = 10 * time.Millisecond
+		storePolicy = StoreBypass
+		index = nil
+		ctx = context.Background()
+		negative = nil
 	})
 
 	JustBeforeEach(func() {
@@ -58,6 +74,15 @@ var _ = Describe("Service", func() {
 			Store:      store,
 			Downloader: downloader,
 			Locker:     locker,
+			Notifier:   notifications,
+			Jobs:       jobs,
+			Index:      index,
+			IndexTTL:   time.Minute,
+			Failures:   negative,
+
+			StorePolicy:      storePolicy,
+			BreakerThreshold: 2,
+			BreakerCooldown:  time.Minute,
 		})
 	})
 
@@ -69,6 +94,8 @@ var _ = Describe("Service", func() {
 
 	Describe("Perform", func() {
 		var result []byte
+		var key string
+		var notModified func(string) bool
 		var err error
 		var data []byte
 		var resData []byte
@@ -78,13 +105,15 @@ var _ = Describe("Service", func() {
 			mtx = lib.NewMockMutex(mockCtrl)
 
 			t.EXPECT().Fingerprint(gomock.Any()).Return(fprint).AnyTimes()
+			t.EXPECT().Params().Return("params").AnyTimes()
 
 			data = []byte("image of flower")
 			resData = []byte("thumbed image of flower")
+			notModified = nil
 		})
 
 		JustBeforeEach(func() {
-			result, err = subject.Perform(url, t)
+			result, key, err = subject.Perform(ctx, url, t, notModified)
 		})
 
 		// shared examples
@@ -96,6 +125,10 @@ var _ = Describe("Service", func() {
 			It("Does not return error", func() {
 				Expect(err).NotTo(HaveOccurred())
 			})
+
+			It("Returns key", func() {
+				Expect(key).To(Equal(fprint))
+			})
 		}
 
 		ItBehavesAsNotPerformed := func() {
@@ -110,73 +143,336 @@ var _ = Describe("Service", func() {
 
 		Context("When downloader can't download from url", func() {
 			BeforeEach(func() {
-				downloader.EXPECT().Download(gomock.Any()).Return([]byte{}, ErrOups)
+				downloader.EXPECT().Download(gomock.Any(), gomock.Any()).Return([]byte{}, lib.Validators{}, ErrOups)
 			})
 
 			ItBehavesAsNotPerformed()
 		})
 
+		Context("When index is used", func() {
+			var idx *MockIndex
+			var indexKey string
+
+			BeforeEach(func() {
+				idx = NewMockIndex(mockCtrl)
+				index = idx
+				indexKey = url + " params"
+			})
+
+			Context("When url is not indexed", func() {
+				var remembered IndexEntry
+
+				BeforeEach(func() {
+					idx.EXPECT().Get(gomock.Any(), indexKey).Return(IndexEntry{}, false)
+					downloader.EXPECT().Download(gomock.Any(), gomock.Any()).Return(data, lib.Validators{ETag: "v1"}, nil)
+					idx.EXPECT().Set(gomock.Any(), indexKey, gomock.Any()).Do(func(_ context.Context, _ string, e IndexEntry) { remembered = e })
+					store.EXPECT().Get(gomock.Any(), fprint).Return(resData, true, nil)
+				})
+
+				ItBehavesAsPerformed()
+
+				It("Remembers fingerprint and validators", func() {
+					Expect(remembered.Fingerprint).To(Equal(fprint))
+					Expect(remembered.Validators).To(Equal(lib.Validators{ETag: "v1"}))
+					Expect(remembered.Expires).To(BeTemporally(">", time.Now()))
+				})
+			})
+
+			Context("When index entry is fresh", func() {
+				BeforeEach(func() {
+					idx.EXPECT().Get(gomock.Any(), indexKey).Return(IndexEntry{Fingerprint: fprint, Expires: time.Now().Add(time.Minute)}, true)
+				})
+
+				Context("When data is in store", func() {
+					BeforeEach(func() {
+						store.EXPECT().Get(gomock.Any(), fprint).Return(resData, true, nil)
+					})
+
+					// downloader is not expected to be called
+					ItBehavesAsPerformed()
+				})
+
+				Context("When result is known to the caller", func() {
+					BeforeEach(func() {
+						notModified = func(key string) bool { return key == fprint }
+					})
+
+					It("Returns ErrNotModified", func() {
+						Expect(err).To(Equal(ErrNotModified))
+						Expect(key).To(Equal(fprint))
+					})
+				})
+
+				Context("When data is gone from store", func() {
+					BeforeEach(func() {
+						store.EXPECT().Get(gomock.Any(), fprint).Return(nil, false, nil)
+						downloader.EXPECT().Download(gomock.Any(), gomock.Any()).Return(data, lib.Validators{}, nil)
+						idx.EXPECT().Set(gomock.Any(), indexKey, gomock.Any())
+
+						locker.EXPECT().NewMutex(fprint).Return(mtx)
+						mtx.EXPECT().Lock(gomock.Any()).Return(nil)
+						t.EXPECT().Perform(gomock.Any(), data).Return(resData, nil)
+						store.EXPECT().Set(gomock.Any(), fprint, resData).Return(nil)
+						mtx.EXPECT().Extend().Return(true)
+					})
+
+					ItBehavesAsPerformed()
+				})
+			})
+
+			Context("When index entry is expired", func() {
+				BeforeEach(func() {
+					idx.EXPECT().Get(gomock.Any(), indexKey).Return(IndexEntry{
+						Fingerprint: fprint,
+						Validators:  lib.Validators{ETag: "v1"},
+						Expires:     time.Now().Add(-time.Second),
+					}, true)
+				})
+
+				Context("When source is not changed", func() {
+					BeforeEach(func() {
+						downloader.EXPECT().DownloadIfModified(gomock.Any(), gomock.Any()).Return(nil, lib.Validators{ETag: "v1"}, lib.ErrSourceNotModified)
+						idx.EXPECT().Set(gomock.Any(), indexKey, gomock.Any())
+						store.EXPECT().Get(gomock.Any(), fprint).Return(resData, true, nil)
+					})
+
+					ItBehavesAsPerformed()
+				})
+
+				Context("When downloader revalidated other version", func() {
+					BeforeEach(func() {
+						downloader.EXPECT().DownloadIfModified(gomock.Any(), gomock.Any()).Return(nil, lib.Validators{ETag: "v2"}, lib.ErrSourceNotModified)
+						downloader.EXPECT().Download(gomock.Any(), gomock.Any()).Return(data, lib.Validators{ETag: "v2"}, nil)
+						idx.EXPECT().Set(gomock.Any(), indexKey, gomock.Any())
+						store.EXPECT().Get(gomock.Any(), fprint).Return(resData, true, nil)
+					})
+
+					ItBehavesAsPerformed()
+				})
+
+				Context("When source is changed", func() {
+					BeforeEach(func() {
+						// source is downloaded once
+						downloader.EXPECT().DownloadIfModified(gomock.Any(), gomock.Any()).Return(data, lib.Validators{ETag: "v2"}, nil)
+						idx.EXPECT().Set(gomock.Any(), indexKey, gomock.Any())
+						store.EXPECT().Get(gomock.Any(), fprint).Return(resData, true, nil)
+					})
+
+					ItBehavesAsPerformed()
+				})
+			})
+		})
+
 		Context("When url is downloadable", func() {
 			BeforeEach(func() {
-				downloader.EXPECT().Download(gomock.Any()).Return(data, nil)
+				downloader.EXPECT().Download(gomock.Any(), gomock.Any()).Return(data, lib.Validators{}, nil)
+			})
+
+			Context("When result is known to the caller", func() {
+				BeforeEach(func() {
+					notModified = func(key string) bool { return key == fprint }
+				})
+
+				It("Returns ErrNotModified", func() {
+					Expect(err).To(Equal(ErrNotModified))
+					Expect(key).To(Equal(fprint))
+					Expect(result).To(BeEmpty())
+				})
 			})
 
 			Context("When data already in store", func() {
 				BeforeEach(func() {
-					storeGetCalls = append(storeGetCalls, store.EXPECT().Get(fprint).Return(resData))
+					storeGetCalls = append(storeGetCalls, store.EXPECT().Get(gomock.Any(), fprint).Return(resData, true, nil))
 				})
 
 				ItBehavesAsPerformed()
 			})
 
+			Context("When store fails", func() {
+				BeforeEach(func() {
+					storeGetCalls = append(storeGetCalls, store.EXPECT().Get(gomock.Any(), fprint).Return(nil, false, ErrOups))
+				})
+
+				Context("When store is bypassed", func() {
+					BeforeEach(func() {
+						t.EXPECT().Perform(gomock.Any(), data).Return(resData, nil)
+						store.EXPECT().Set(gomock.Any(), fprint, resData).Return(ErrOups)
+					})
+
+					ItBehavesAsPerformed()
+
+					It("Stops calling store after repeated failures", func() {
+						t.EXPECT().Perform(gomock.Any(), data).Return(resData, nil)
+						downloader.EXPECT().Download(gomock.Any(), gomock.Any()).Return(data, lib.Validators{}, nil)
+
+						result, _, err := subject.Perform(ctx, url, t, nil)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(result).To(Equal(resData))
+					})
+				})
+
+				Context("When failing fast", func() {
+					BeforeEach(func() {
+						storePolicy = StoreFailFast
+					})
+
+					It("Returns store unavailable error", func() {
+						Expect(result).To(BeEmpty())
+						Expect(err).To(BeAssignableToTypeOf(lib.Error{}))
+						Expect(err.(lib.Error).Code()).To(Equal(503))
+					})
+				})
+			})
+
+			Context("When recent job failed", func() {
+				BeforeEach(func() {
+					storeGetCalls = append(storeGetCalls, store.EXPECT().Get(gomock.Any(), fprint).Return(nil, false, nil))
+				})
+
+				Context("With lib.Error", func() {
+					BeforeEach(func() {
+						jobs.Set(ctx, fprint, lib.JobState{Status: lib.JobFailed, Err: lib.NewError(ErrOups, lib.TransformationFailure)})
+					})
+
+					ItBehavesAsNotPerformed()
+
+					It("Returns original error type", func() {
+						Expect(err.(lib.Error).Type()).To(Equal(lib.TransformationFailure))
+					})
+				})
+
+				Context("With transient error", func() {
+					BeforeEach(func() {
+						jobs.Set(ctx, fprint, lib.JobState{Status: lib.JobFailed, Err: ErrOnStore})
+
+						locker.EXPECT().NewMutex(fprint).Return(mtx)
+						mtx.EXPECT().Lock(gomock.Any()).Return(nil)
+						t.EXPECT().Perform(gomock.Any(), data).Return(resData, nil)
+						store.EXPECT().Set(gomock.Any(), fprint, resData).Return(nil)
+						mtx.EXPECT().Extend().Return(true)
+					})
+
+					ItBehavesAsPerformed()
+				})
+			})
+
 			Context("When data not in store", func() {
 				BeforeEach(func() {
-					storeGetCalls = append(storeGetCalls, store.EXPECT().Get(fprint).Return([]byte{}))
+					storeGetCalls = append(storeGetCalls, store.EXPECT().Get(gomock.Any(), fprint).Return(nil, false, nil))
 					lockerNewMutexCalls = append(lockerNewMutexCalls, locker.EXPECT().NewMutex(fprint).Return(mtx))
 				})
 
 				WhenMutexAquired := func() {
 					Context("When mutex acquired", func() {
+						var outcomes <-chan error
+
 						BeforeEach(func() {
-							mtxLockCalls = append(mtxLockCalls, mtx.EXPECT().Lock().Return(nil))
+							mtxLockCalls = append(mtxLockCalls, mtx.EXPECT().Lock(gomock.Any()).Do(func(context.Context) {
+								outcomes, _ = notifications.Subscribe(ctx, fprint)
+							}).Return(nil))
 						})
 
 						Context("When can't perform transformation", func() {
 							BeforeEach(func() {
-								t.EXPECT().Perform(data).Return([]byte{}, ErrOups)
+								t.EXPECT().Perform(gomock.Any(), data).Return([]byte{}, ErrOups)
 								mtx.EXPECT().Unlock().Return(true)
 							})
 
 							ItBehavesAsNotPerformed()
+
+							It("Records failure", func() {
+								state, ok := jobs.Get(ctx, fprint)
+								Expect(ok).To(BeTrue())
+								Expect(state.Status).To(Equal(lib.JobFailed))
+								Expect(state.Err).To(MatchError(ErrOups))
+							})
+						})
+
+						Context("When transformation fails in a way that is bound to repeat", func() {
+							var failure lib.Error
+
+							BeforeEach(func() {
+								failure = lib.NewError(ErrOups, lib.UnsupportedContentType)
+								t.EXPECT().Perform(gomock.Any(), data).Return([]byte{}, failure)
+								mtx.EXPECT().Unlock().Return(true)
+							})
+
+							ItBehavesAsNotPerformed()
+
+							It("Tells waiters to fail the same way", func() {
+								Expect(outcomes).To(Receive(Equal(failure)))
+
+								state, _ := jobs.Get(ctx, fprint)
+								Expect(state.Err).To(Equal(failure))
+							})
+						})
+
+						Context("When transformation fails in a way that is worth retrying", func() {
+							BeforeEach(func() {
+								t.EXPECT().Perform(gomock.Any(), data).Return([]byte{}, lib.NewError(ErrOups, lib.SourceTimeout))
+								mtx.EXPECT().Unlock().Return(true)
+							})
+
+							ItBehavesAsNotPerformed()
+
+							It("Tells waiters to retry", func() {
+								Expect(outcomes).To(Receive(Equal(ErrTransient)))
+
+								state, _ := jobs.Get(ctx, fprint)
+								Expect(state.Err).To(Equal(ErrTransient))
+							})
 						})
 
 						Context("When transformation is performed", func() {
 							BeforeEach(func() {
-								t.EXPECT().Perform(data).Return(resData, nil)
+								t.EXPECT().Perform(gomock.Any(), data).Return(resData, nil)
 							})
 
 							Context("When transformed value is stored successfully", func() {
 								BeforeEach(func() {
-									storeGetCalls = append(storeGetCalls, store.EXPECT().Set(fprint, resData).Return(nil))
+									storeGetCalls = append(storeGetCalls, store.EXPECT().Set(gomock.Any(), fprint, resData).Return(nil))
 									mtx.EXPECT().Extend().Return(true)
 								})
 
 								ItBehavesAsPerformed()
+
+								It("Notifies waiters", func() {
+									Expect(outcomes).To(Receive(BeNil()))
+								})
+
+								It("Records completion", func() {
+									state, ok := jobs.Get(ctx, fprint)
+									Expect(ok).To(BeTrue())
+									Expect(state.Status).To(Equal(lib.JobDone))
+								})
 							})
 
 							Context("When transformed value is not stored", func() {
 								BeforeEach(func() {
-									storeGetCalls = append(storeGetCalls, store.EXPECT().Set(fprint, resData).Return(ErrOups))
+									storeGetCalls = append(storeGetCalls, store.EXPECT().Set(gomock.Any(), fprint, resData).Return(ErrOups))
+									mtx.EXPECT().Unlock().Return(true)
+								})
+
+								ItBehavesAsPerformed()
+							})
+
+							Context("When transformed value is too large to store", func() {
+								BeforeEach(func() {
+									storeGetCalls = append(storeGetCalls, store.EXPECT().Set(gomock.Any(), fprint, resData).Return(ErrTooLarge))
 									mtx.EXPECT().Unlock().Return(true)
 								})
 
 								ItBehavesAsPerformed()
+
+								It("Tells waiters to perform it themselves", func() {
+									Expect(outcomes).To(Receive(Equal(ErrOnStore)))
+								})
 							})
 						})
 
 						Context("When transformation is not performed", func() {
 							BeforeEach(func() {
-								t.EXPECT().Perform(data).Return([]byte{}, ErrOups)
+								t.EXPECT().Perform(gomock.Any(), data).Return([]byte{}, ErrOups)
 								mtx.EXPECT().Unlock().Return(true)
 							})
 
@@ -188,33 +484,68 @@ var _ = Describe("Service", func() {
 				WhenMutexAquired()
 
 				Context("When mutex not acquired", func() {
+					var outcome error
+					var published bool
+					var recorded bool
+
 					BeforeEach(func() {
-						mtxLockCalls = append(mtxLockCalls, mtx.EXPECT().Lock().Return(ErrOups))
+						published = false
+						recorded = false
+
+						mtxLockCalls = append(mtxLockCalls, mtx.EXPECT().Lock(gomock.Any()).Do(func(context.Context) {
+							if recorded {
+								jobs.Set(ctx, fprint, lib.JobState{Status: lib.JobFailed, Err: outcome})
+							}
+							if published {
+								notifications.Publish(ctx, fprint, outcome)
+							}
+						}).Return(ErrOups))
 					})
 
-					Describe("Store Polling", func() {
-						Context("When data is immediately in store", func() {
+					Describe("Awaiting holder", func() {
+						Context("When data is already in store", func() {
 							BeforeEach(func() {
-								storeGetCalls = append(storeGetCalls, store.EXPECT().Get(fprint).Return(resData))
+								storeGetCalls = append(storeGetCalls, store.EXPECT().Get(gomock.Any(), fprint).Return(resData, true, nil))
 							})
 
 							ItBehavesAsPerformed()
 						})
 
-						Context("When data is in store after another poll", func() {
+						Context("When holder notifies about completion", func() {
 							BeforeEach(func() {
-								storeGetCalls = append(storeGetCalls, store.EXPECT().Get(fprint).Return([]byte{}))
-								storeGetCalls = append(storeGetCalls, store.EXPECT().Get(fprint).Return(resData))
+								published = true
+								outcome = nil
+
+								storeGetCalls = append(storeGetCalls, store.EXPECT().Get(gomock.Any(), fprint).Return(nil, false, nil))
+								storeGetCalls = append(storeGetCalls, store.EXPECT().Get(gomock.Any(), fprint).Return(resData, true, nil))
 							})
 
 							ItBehavesAsPerformed()
 						})
 
-						Context("When data is not in store after all polls", func() {
+						Context("When holder notifies about failure", func() {
 							BeforeEach(func() {
-								storeGetCalls = append(storeGetCalls, store.EXPECT().Get(fprint).Return([]byte{}))
-								storeGetCalls = append(storeGetCalls, store.EXPECT().Get(fprint).Return([]byte{}))
-								storeGetCalls = append(storeGetCalls, store.EXPECT().Get(fprint).Return([]byte{}))
+								published = true
+								outcome = lib.NewError(ErrOups, lib.UnsupportedContentType)
+
+								storeGetCalls = append(storeGetCalls, store.EXPECT().Get(gomock.Any(), fprint).Return(nil, false, nil))
+							})
+
+							ItBehavesAsNotPerformed()
+						})
+
+						Context("When holder recorded failure but notification is lost", func() {
+							BeforeEach(func() {
+								recorded = true
+								outcome = lib.NewError(ErrOups, lib.UnsupportedContentType)
+							})
+
+							ItBehavesAsNotPerformed()
+						})
+
+						WhenHolderGone := func() {
+							BeforeEach(func() {
+								storeGetCalls = append(storeGetCalls, store.EXPECT().Get(gomock.Any(), fprint).Return(nil, false, nil))
 
 								lockerNewMutexCalls = append(lockerNewMutexCalls, locker.EXPECT().NewMutex(fprint).Return(mtx))
 							})
@@ -223,23 +554,343 @@ var _ = Describe("Service", func() {
 
 							Context("When mutex not acquired", func() {
 								BeforeEach(func() {
-									storeGetCalls = append(storeGetCalls, store.EXPECT().Get(fprint).Return([]byte{}))
-									storeGetCalls = append(storeGetCalls, store.EXPECT().Get(fprint).Return([]byte{}))
-									storeGetCalls = append(storeGetCalls, store.EXPECT().Get(fprint).Return([]byte{}))
+									storeGetCalls = append(storeGetCalls, store.EXPECT().Get(gomock.Any(), fprint).Return(nil, false, nil))
 
-									mtxLockCalls = append(mtxLockCalls, mtx.EXPECT().Lock().Return(ErrOups))
+									mtxLockCalls = append(mtxLockCalls, mtx.EXPECT().Lock(gomock.Any()).Return(ErrOups))
 
-									t.EXPECT().Perform(data).Return(resData, nil)
+									t.EXPECT().Perform(gomock.Any(), data).Return(resData, nil)
 
-									storeGetCalls = append(storeGetCalls, store.EXPECT().Set(fprint, resData).Return(nil))
+									storeGetCalls = append(storeGetCalls, store.EXPECT().Set(gomock.Any(), fprint, resData).Return(nil))
 								})
 
 								ItBehavesAsPerformed()
 							})
+						}
+
+						Context("When holder notifies about transient failure", func() {
+							BeforeEach(func() {
+								published = true
+								outcome = ErrOnStore
+							})
+
+							WhenHolderGone()
+						})
+
+						Context("When holder does not notify", func() {
+							WhenHolderGone()
 						})
 					})
 				})
 			})
 		})
 	})
+
+	Describe("Remembered failures", func() {
+		var data []byte
+		var failure lib.Error
+
+		BeforeEach(func() {
+			data = []byte("not an image")
+			negative = failures.NewMemory(10, time.Minute)
+			failure = lib.NewError(ErrOups, lib.UnsupportedContentType)
+
+			t.EXPECT().Fingerprint(gomock.Any()).Return(fprint).AnyTimes()
+			t.EXPECT().Params().Return("params").AnyTimes()
+		})
+
+		Context("When url can't be downloaded", func() {
+			It("Does not download it again", func() {
+				downloader.EXPECT().Download(gomock.Any(), "url").Return(nil, lib.Validators{}, failure)
+
+				for i := 0; i < 2; i++ {
+					_, _, err := subject.Perform(ctx, "url", t, nil)
+					Expect(err).To(BeAssignableToTypeOf(lib.Error{}))
+					Expect(err.(lib.Error).Code()).To(Equal(400))
+				}
+			})
+
+			It("Downloads it again after error that is not known to repeat", func() {
+				downloader.EXPECT().Download(gomock.Any(), "url").Return(nil, lib.Validators{}, ErrOups).Times(2)
+
+				for i := 0; i < 2; i++ {
+					_, _, err := subject.Perform(ctx, "url", t, nil)
+					Expect(err).To(MatchError(ErrOups))
+				}
+			})
+
+			It("Downloads it again after transient failure", func() {
+				outage := lib.NewError(ErrOups, lib.ResourceUnreachable)
+				downloader.EXPECT().Download(gomock.Any(), "url").Return(nil, lib.Validators{}, outage).Times(2)
+
+				for i := 0; i < 2; i++ {
+					_, _, err := subject.Perform(ctx, "url", t, nil)
+					Expect(err).To(Equal(outage))
+				}
+			})
+		})
+
+		Context("When source can't be decoded", func() {
+			It("Does not decode it again", func() {
+				mtx := lib.NewMockMutex(mockCtrl)
+
+				downloader.EXPECT().Download(gomock.Any(), gomock.Any()).Return(data, lib.Validators{}, nil).Times(2)
+				store.EXPECT().Get(gomock.Any(), fprint).Return(nil, false, nil).Times(2)
+				locker.EXPECT().NewMutex(fprint).Return(mtx)
+				mtx.EXPECT().Lock(gomock.Any()).Return(nil)
+				t.EXPECT().Perform(gomock.Any(), data).Return(nil, failure)
+				mtx.EXPECT().Unlock().Return(true)
+
+				_, _, err := subject.Perform(ctx, "url", t, nil)
+				Expect(err).To(Equal(failure))
+
+				_, _, err = subject.Perform(ctx, "other url", t, nil)
+				Expect(err).To(BeAssignableToTypeOf(lib.Error{}))
+				Expect(err.(lib.Error).Type()).To(Equal(lib.UnsupportedContentType))
+			})
+
+			It("Does not download its url again", func() {
+				mtx := lib.NewMockMutex(mockCtrl)
+
+				downloader.EXPECT().Download(gomock.Any(), "url").Return(data, lib.Validators{}, nil).Times(1)
+				store.EXPECT().Get(gomock.Any(), fprint).Return(nil, false, nil)
+				locker.EXPECT().NewMutex(fprint).Return(mtx)
+				mtx.EXPECT().Lock(gomock.Any()).Return(nil)
+				t.EXPECT().Perform(gomock.Any(), data).Return(nil, failure)
+				mtx.EXPECT().Unlock().Return(true)
+
+				for i := 0; i < 2; i++ {
+					_, _, err := subject.Perform(ctx, "url", t, nil)
+					Expect(err).To(BeAssignableToTypeOf(lib.Error{}))
+					Expect(err.(lib.Error).Type()).To(Equal(lib.UnsupportedContentType))
+				}
+			})
+		})
+	})
+
+	Describe("Cancellation", func() {
+		var data, resData []byte
+		var mtx *lib.MockMutex
+		var cancel context.CancelFunc
+
+		BeforeEach(func() {
+			data = []byte("image of flower")
+			resData = []byte("thumbed image of flower")
+			mtx = lib.NewMockMutex(mockCtrl)
+			ctx, cancel = context.WithCancel(ctx)
+
+			t.EXPECT().Fingerprint(gomock.Any()).Return(fprint).AnyTimes()
+			t.EXPECT().Params().Return("params").AnyTimes()
+		})
+
+		AfterEach(func() {
+			cancel()
+		})
+
+		It("Stops awaiting holder", func() {
+			AwaitTimeout = time.Minute
+
+			downloader.EXPECT().Download(gomock.Any(), gomock.Any()).Return(data, lib.Validators{}, nil)
+			store.EXPECT().Get(gomock.Any(), fprint).Return(nil, false, nil).Times(2)
+			locker.EXPECT().NewMutex(fprint).Return(mtx)
+			mtx.EXPECT().Lock(gomock.Any()).Return(ErrOups)
+
+			time.AfterFunc(10*time.Millisecond, cancel)
+
+			_, _, err := subject.Perform(ctx, "", t, nil)
+			Expect(err).To(Equal(context.Canceled))
+		})
+
+		Context("When failing fast", func() {
+			BeforeEach(func() {
+				storePolicy = StoreFailFast
+			})
+
+			It("Does not report store as unavailable", func() {
+				downloader.EXPECT().Download(gomock.Any(), gomock.Any()).Return(data, lib.Validators{}, nil)
+				store.EXPECT().Get(gomock.Any(), fprint).Do(func(context.Context, string) {
+					cancel()
+				}).Return(nil, false, context.Canceled)
+
+				_, _, err := subject.Perform(ctx, "", t, nil)
+				Expect(err).To(Equal(context.Canceled))
+			})
+		})
+
+		It("Lets coalesced request do the work once the first one is cancelled", func() {
+			release := make(chan struct{})
+
+			downloader.EXPECT().Download(gomock.Any(), gomock.Any()).Return(data, lib.Validators{}, nil).Times(2)
+			store.EXPECT().Get(gomock.Any(), fprint).Return(nil, false, nil).Times(2)
+			locker.EXPECT().NewMutex(fprint).Return(mtx).Times(2)
+			mtx.EXPECT().Lock(gomock.Any()).Return(nil).Times(2)
+			gomock.InOrder(
+				t.EXPECT().Perform(gomock.Any(), data).Do(func(context.Context, []byte) { <-release }).Return(nil, context.Canceled),
+				t.EXPECT().Perform(gomock.Any(), data).Return(resData, nil),
+			)
+			mtx.EXPECT().Unlock().Return(true)
+			store.EXPECT().Set(gomock.Any(), fprint, resData).Return(nil)
+			mtx.EXPECT().Extend().Return(true)
+
+			cancelled := make(chan error, 1)
+			go func() {
+				defer GinkgoRecover()
+
+				_, _, err := subject.Perform(ctx, "", t, nil)
+				cancelled <- err
+			}()
+
+			// let the first request take the flight
+			time.Sleep(20 * time.Millisecond)
+
+			results := make(chan []byte, 1)
+			go func() {
+				defer GinkgoRecover()
+
+				res, _, err := subject.Perform(context.Background(), "", t, nil)
+				Expect(err).NotTo(HaveOccurred())
+				results <- res
+			}()
+
+			time.Sleep(20 * time.Millisecond)
+			cancel()
+			close(release)
+
+			Eventually(cancelled).Should(Receive(Equal(context.Canceled)))
+			Eventually(results).Should(Receive(Equal(resData)))
+		})
+	})
+
+	Describe("Shutdown", func() {
+		var data, resData []byte
+		var mtx *lib.MockMutex
+
+		BeforeEach(func() {
+			data = []byte("image of flower")
+			resData = []byte("thumbed image of flower")
+			mtx = lib.NewMockMutex(mockCtrl)
+
+			t.EXPECT().Fingerprint(gomock.Any()).Return(fprint).AnyTimes()
+			t.EXPECT().Params().Return("params").AnyTimes()
+		})
+
+		ExpectLocked := func() {
+			downloader.EXPECT().Download(gomock.Any(), gomock.Any()).Return(data, lib.Validators{}, nil)
+			store.EXPECT().Get(gomock.Any(), fprint).Return(nil, false, nil)
+			locker.EXPECT().NewMutex(fprint).Return(mtx)
+			mtx.EXPECT().Lock(gomock.Any()).Return(nil)
+		}
+
+		It("Waits for in-flight work", func() {
+			release := make(chan struct{})
+
+			ExpectLocked()
+			t.EXPECT().Perform(gomock.Any(), data).Do(func(context.Context, []byte) { <-release }).Return(resData, nil)
+			store.EXPECT().Set(gomock.Any(), fprint, resData).Return(nil)
+			mtx.EXPECT().Extend().Return(true)
+
+			results := make(chan []byte, 1)
+			go func() {
+				defer GinkgoRecover()
+
+				res, _, err := subject.Perform(ctx, "", t, nil)
+				Expect(err).NotTo(HaveOccurred())
+				results <- res
+			}()
+
+			// let the request start
+			time.Sleep(20 * time.Millisecond)
+
+			drained := make(chan error, 1)
+			go func() {
+				drained <- subject.Shutdown(context.Background())
+			}()
+
+			Consistently(drained, 30*time.Millisecond).ShouldNot(Receive())
+
+			close(release)
+
+			Eventually(drained).Should(Receive(BeNil()))
+			Eventually(results).Should(Receive(Equal(resData)))
+		})
+
+		It("Cancels work that does not finish in time", func() {
+			ExpectLocked()
+			t.EXPECT().Perform(gomock.Any(), data).Do(func(ctx context.Context, _ []byte) {
+				<-ctx.Done()
+			}).Return(nil, context.Canceled)
+			mtx.EXPECT().Unlock().Return(true)
+
+			errs := make(chan error, 1)
+			go func() {
+				_, _, err := subject.Perform(ctx, "", t, nil)
+				errs <- err
+			}()
+
+			time.Sleep(20 * time.Millisecond)
+
+			deadline, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+
+			Expect(subject.Shutdown(deadline)).To(Equal(context.DeadlineExceeded))
+
+			var err error
+			Eventually(errs).Should(Receive(&err))
+			Expect(err).To(BeAssignableToTypeOf(lib.Error{}))
+			Expect(err.(lib.Error).Code()).To(Equal(503))
+		})
+
+		It("Rejects new work", func() {
+			Expect(subject.Shutdown(context.Background())).To(Succeed())
+
+			_, _, err := subject.Perform(ctx, "", t, nil)
+			Expect(err).To(BeAssignableToTypeOf(lib.Error{}))
+			Expect(err.(lib.Error).Type()).To(Equal(lib.ShuttingDown))
+		})
+	})
+
+	Describe("Concurrent Perform", func() {
+		var data, resData []byte
+		var release chan struct{}
+		var mtx *lib.MockMutex
+
+		BeforeEach(func() {
+			data = []byte("image of flower")
+			resData = []byte("thumbed image of flower")
+			release = make(chan struct{})
+			mtx = lib.NewMockMutex(mockCtrl)
+
+			t.EXPECT().Fingerprint(gomock.Any()).Return(fprint).AnyTimes()
+			t.EXPECT().Params().Return("params").AnyTimes()
+			downloader.EXPECT().Download(gomock.Any(), gomock.Any()).Return(data, lib.Validators{}, nil).Times(2)
+			store.EXPECT().Get(gomock.Any(), fprint).Return(nil, false, nil).Times(2)
+
+			// the work is done once
+			locker.EXPECT().NewMutex(fprint).Return(mtx)
+			mtx.EXPECT().Lock(gomock.Any()).Return(nil)
+			t.EXPECT().Perform(gomock.Any(), data).Do(func(context.Context, []byte) { <-release }).Return(resData, nil)
+			store.EXPECT().Set(gomock.Any(), fprint, resData).Return(nil)
+			mtx.EXPECT().Extend().Return(true)
+		})
+
+		It("Coalesces identical requests", func() {
+			results := make(chan []byte, 2)
+
+			for i := 0; i < 2; i++ {
+				go func() {
+					defer GinkgoRecover()
+
+					res, _, err := subject.Perform(ctx, "", t, nil)
+					Expect(err).NotTo(HaveOccurred())
+					results <- res
+				}()
+			}
+
+			// let both requests reach the flight
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+
+			Eventually(results).Should(Receive(Equal(resData)))
+			Eventually(results).Should(Receive(Equal(resData)))
+		})
+	})
 })
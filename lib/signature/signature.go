@@ -0,0 +1,101 @@
+// Package signature signs and verifies thumbnail requests,
+// so that only urls produced by holders of the shared secret are served.
+//
+// Signature is HMAC-SHA256 over canonical query: all params except sig,
+// sorted by name and url encoded. Optional expires param holds unix timestamp
+// after which signed request is rejected.
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	SigParam     = "sig"
+	ExpiresParam = "expires"
+)
+
+var (
+	ErrMissing = errors.New("signature is missing")
+	ErrInvalid = errors.New("signature is invalid")
+	ErrExpired = errors.New("signature is expired")
+)
+
+// Sign returns signature of the query, sig param itself is ignored
+func Sign(secret []byte, query url.Values) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(canonical(query)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignURL appends params, expires (unless zero) and signature to endpoint url, e.g.
+//
+//	signature.SignURL(secret, "https://thumbs.example.com/thumbnail", url.Values{
+//		"url":    {"https://example.com/img.jpg"},
+//		"width":  {"200"},
+//		"height": {"100"},
+//	}, time.Now().Add(time.Hour))
+func SignURL(secret []byte, endpoint string, params url.Values, expires time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	for k, v := range params {
+		query[k] = v
+	}
+
+	if !expires.IsZero() {
+		query.Set(ExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+	}
+
+	query.Set(SigParam, Sign(secret, query))
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// Verify checks signature of the query and its expiration against now
+func Verify(secret []byte, query url.Values, now time.Time) error {
+	sig := query.Get(SigParam)
+	if sig == "" {
+		return ErrMissing
+	}
+
+	expected := Sign(secret, query)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return ErrInvalid
+	}
+
+	if exp := query.Get(ExpiresParam); exp != "" {
+		ts, err := strconv.ParseInt(exp, 10, 64)
+		if err != nil {
+			return ErrInvalid
+		}
+
+		if now.Unix() > ts {
+			return ErrExpired
+		}
+	}
+
+	return nil
+}
+
+func canonical(query url.Values) string {
+	q := url.Values{}
+	for k, v := range query {
+		if k != SigParam {
+			q[k] = v
+		}
+	}
+
+	// Encode sorts params by name
+	return q.Encode()
+}
@@ -0,0 +1,104 @@
+package signature
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func Test(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Signature Suite")
+}
+
+var _ = Describe("Signature", func() {
+	var secret = []byte("secret")
+	var now time.Time
+	var expires time.Time
+	var query url.Values
+	var err error
+
+	BeforeEach(func() {
+		now = time.Unix(1500000000, 0)
+		expires = time.Time{}
+	})
+
+	JustBeforeEach(func() {
+		signed, e := SignURL(secret, "http://localhost:8080/thumbnail", url.Values{
+			"url":    {"http://foo.com/sample.jpg"},
+			"width":  {"200"},
+			"height": {"100"},
+		}, expires)
+		Expect(e).NotTo(HaveOccurred())
+
+		u, e := url.Parse(signed)
+		Expect(e).NotTo(HaveOccurred())
+
+		query = u.Query()
+	})
+
+	Describe("Verify", func() {
+		Context("When query is intact", func() {
+			It("Passes", func() {
+				Expect(Verify(secret, query, now)).To(Succeed())
+			})
+		})
+
+		Context("When query is tampered", func() {
+			JustBeforeEach(func() {
+				query.Set("width", "2000")
+				err = Verify(secret, query, now)
+			})
+
+			It("Is invalid", func() {
+				Expect(err).To(Equal(ErrInvalid))
+			})
+		})
+
+		Context("When params are added", func() {
+			JustBeforeEach(func() {
+				query.Set("quality", "10")
+				err = Verify(secret, query, now)
+			})
+
+			It("Is invalid", func() {
+				Expect(err).To(Equal(ErrInvalid))
+			})
+		})
+
+		Context("When secret differs", func() {
+			It("Is invalid", func() {
+				Expect(Verify([]byte("other"), query, now)).To(Equal(ErrInvalid))
+			})
+		})
+
+		Context("When signature is missing", func() {
+			It("Is missing", func() {
+				query.Del(SigParam)
+				Expect(Verify(secret, query, now)).To(Equal(ErrMissing))
+			})
+		})
+
+		Context("When expiring", func() {
+			BeforeEach(func() {
+				expires = now.Add(time.Minute)
+			})
+
+			It("Passes before expiration", func() {
+				Expect(Verify(secret, query, now)).To(Succeed())
+			})
+
+			It("Is expired after expiration", func() {
+				Expect(Verify(secret, query, now.Add(2*time.Minute))).To(Equal(ErrExpired))
+			})
+
+			It("Is invalid when expiration is extended", func() {
+				query.Set(ExpiresParam, "9999999999")
+				Expect(Verify(secret, query, now)).To(Equal(ErrInvalid))
+			})
+		})
+	})
+})
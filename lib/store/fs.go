@@ -0,0 +1,183 @@
+package store
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bobochka/thumbnail_service/lib/lru"
+)
+
+// FS stores data in files under root directory.
+// Files are sharded into nested directories by key hash, so that none of directories grows too big.
+// When maxSize is positive, least recently used files are evicted once total size exceeds it.
+type FS struct {
+	root string
+
+	mu  sync.Mutex
+	lru *lru.Cache // of file paths, sized by file size
+}
+
+const tmpPrefix = ".tmp-"
+
+func NewFS(root string, maxSize int64) (*FS, error) {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FS{
+		root: root,
+		lru: lru.New(maxSize, func(path string, _ interface{}) {
+			removeFile(path)
+		}),
+	}
+
+	err = s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *FS) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	path := s.path(key)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	s.mu.Lock()
+	s.lru.Get(path)
+	s.mu.Unlock()
+
+	// mtime keeps recency across restarts
+	now := time.Now()
+	os.Chtimes(path, now, now)
+
+	return data, true, nil
+}
+
+func (s *FS) Set(ctx context.Context, key string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	path := s.path(key)
+	dir := filepath.Dir(path)
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	// write to temp file first and then rename it,
+	// so that concurrent readers never see partially written file
+	tmp, err := ioutil.TempFile(dir, tmpPrefix)
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.add(path, int64(len(data)))
+
+	return nil
+}
+
+func (s *FS) path(key string) string {
+	sum := sha1.Sum([]byte(key))
+	hash := hex.EncodeToString(sum[:])
+
+	return filepath.Join(s.root, hash[0:2], hash[2:4], key)
+}
+
+// load indexes files already stored under root, ordering them by modification time
+func (s *FS) load() error {
+	type file struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	var files []file
+
+	err := filepath.Walk(s.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// leftovers of interrupted writes
+		if strings.HasPrefix(info.Name(), tmpPrefix) {
+			return os.Remove(path)
+		}
+
+		if info.Mode().IsRegular() {
+			files = append(files, file{path, info.Size(), info.ModTime()})
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, f := range files {
+		s.add(f.path, f.size)
+	}
+
+	return nil
+}
+
+// add expects mu to be held, files bigger than the whole size are removed right away
+func (s *FS) add(path string, size int64) {
+	if !s.lru.Set(path, nil, size) {
+		removeFile(path)
+	}
+}
+
+func removeFile(path string) {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("unable to evict from fs: %+v\n", err)
+	}
+}
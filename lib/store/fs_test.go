@@ -0,0 +1,132 @@
+package store
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Bobochka/thumbnail_service/lib/service"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func Test(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Store Suite")
+}
+
+var ctx = context.Background()
+
+// lookup returns data found under key or nil, expecting store to not fail
+func lookup(s service.Store, key string) []byte {
+	data, found, err := s.Get(ctx, key)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+	if !found {
+		return nil
+	}
+
+	return data
+}
+
+var _ = Describe("FS", func() {
+	var subject *FS
+	var root string
+	var maxSize int64
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "fs_store")
+		Expect(err).NotTo(HaveOccurred())
+
+		maxSize = 0
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		subject, err = NewFS(root, maxSize)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("Returns stored data", func() {
+		Expect(subject.Set(ctx, "foo", []byte("bar"))).To(Succeed())
+		Expect(lookup(subject, "foo")).To(Equal([]byte("bar")))
+	})
+
+	It("Reports unknown key as not found", func() {
+		_, found, err := subject.Get(ctx, "foo")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeFalse())
+	})
+
+	It("Overwrites data", func() {
+		Expect(subject.Set(ctx, "foo", []byte("bar"))).To(Succeed())
+		Expect(subject.Set(ctx, "foo", []byte("baz"))).To(Succeed())
+		Expect(lookup(subject, "foo")).To(Equal([]byte("baz")))
+	})
+
+	It("Shards files into nested directories", func() {
+		Expect(subject.Set(ctx, "foo", []byte("bar"))).To(Succeed())
+
+		matches, err := filepath.Glob(filepath.Join(root, "*", "*", "foo"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(matches).To(HaveLen(1))
+	})
+
+	It("Leaves no temp files", func() {
+		Expect(subject.Set(ctx, "foo", []byte("bar"))).To(Succeed())
+
+		matches, err := filepath.Glob(filepath.Join(root, "*", "*", tmpPrefix+"*"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(matches).To(BeEmpty())
+	})
+
+	It("Keeps data across instances", func() {
+		Expect(subject.Set(ctx, "foo", []byte("bar"))).To(Succeed())
+
+		other, err := NewFS(root, maxSize)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lookup(other, "foo")).To(Equal([]byte("bar")))
+	})
+
+	Context("When size is bounded", func() {
+		BeforeEach(func() {
+			maxSize = 6
+		})
+
+		It("Removes files of evicted data", func() {
+			Expect(subject.Set(ctx, "a", []byte("aa"))).To(Succeed())
+			Expect(subject.Set(ctx, "b", []byte("bb"))).To(Succeed())
+			Expect(subject.Set(ctx, "c", []byte("cc"))).To(Succeed())
+			Expect(subject.Set(ctx, "d", []byte("dd"))).To(Succeed())
+
+			_, err := os.Stat(subject.path("a"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+			Expect(lookup(subject, "d")).To(Equal([]byte("dd")))
+		})
+
+		It("Removes file bigger than the whole size", func() {
+			Expect(subject.Set(ctx, "a", make([]byte, maxSize+1))).To(Succeed())
+
+			_, err := os.Stat(subject.path("a"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("Evicts on load", func() {
+			unbounded, err := NewFS(root, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(unbounded.Set(ctx, "a", []byte("aaaa"))).To(Succeed())
+			Expect(unbounded.Set(ctx, "b", []byte("bbbb"))).To(Succeed())
+
+			bounded, err := NewFS(root, maxSize)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bounded.lru.Size()).To(BeNumerically("<=", maxSize))
+		})
+	})
+})
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Bobochka/thumbnail_service/lib/lru"
+	"github.com/Bobochka/thumbnail_service/lib/service"
+)
+
+// Memory is an in-process LRU cache tier in front of another store.
+// Its capacity is bounded by total size of cached data rather than by number of entries.
+type Memory struct {
+	next service.Store
+
+	mu  sync.Mutex
+	lru *lru.Cache // of []byte
+
+	hits   uint64
+	misses uint64
+}
+
+func NewMemory(next service.Store, maxBytes int64) *Memory {
+	return &Memory{
+		next: next,
+		lru:  lru.New(maxBytes, nil),
+	}
+}
+
+func (m *Memory) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	v, ok := m.lru.Get(key)
+	m.mu.Unlock()
+
+	if ok {
+		atomic.AddUint64(&m.hits, 1)
+		return v.([]byte), true, nil
+	}
+
+	atomic.AddUint64(&m.misses, 1)
+
+	data, found, err := m.next.Get(ctx, key)
+	if found {
+		m.add(key, data)
+	}
+
+	return data, found, err
+}
+
+func (m *Memory) Set(ctx context.Context, key string, data []byte) error {
+	err := m.next.Set(ctx, key, data)
+	if err != nil {
+		return err
+	}
+
+	m.add(key, data)
+
+	return nil
+}
+
+// Stats returns number of requests served from memory and passed to the next store, as well as size of cached data
+func (m *Memory) Stats() (hits, misses uint64, bytes int64) {
+	m.mu.Lock()
+	bytes = m.lru.Size()
+	m.mu.Unlock()
+
+	return atomic.LoadUint64(&m.hits), atomic.LoadUint64(&m.misses), bytes
+}
+
+// add does not keep data bigger than the whole budget
+func (m *Memory) add(key string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lru.Set(key, data, int64(len(data)))
+}
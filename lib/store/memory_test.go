@@ -0,0 +1,91 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/Bobochka/thumbnail_service/lib/service"
+	"github.com/golang/mock/gomock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Memory", func() {
+	var subject *Memory
+	var next *service.MockStore
+	var mockCtrl *gomock.Controller
+
+	BeforeEach(func() {
+		mockCtrl = gomock.NewController(GinkgoT())
+		next = service.NewMockStore(mockCtrl)
+		subject = NewMemory(next, 6)
+	})
+
+	AfterEach(func() {
+		mockCtrl.Finish()
+	})
+
+	Context("When data is set", func() {
+		BeforeEach(func() {
+			next.EXPECT().Set(gomock.Any(), "a", []byte("aa")).Return(nil)
+			Expect(subject.Set(ctx, "a", []byte("aa"))).To(Succeed())
+		})
+
+		It("Serves it from memory", func() {
+			Expect(lookup(subject, "a")).To(Equal([]byte("aa")))
+
+			hits, misses, bytes := subject.Stats()
+			Expect(hits).To(Equal(uint64(1)))
+			Expect(misses).To(BeZero())
+			Expect(bytes).To(Equal(int64(2)))
+		})
+	})
+
+	Context("When next store fails to set", func() {
+		BeforeEach(func() {
+			next.EXPECT().Set(gomock.Any(), "a", []byte("aa")).Return(errors.New("oups"))
+			Expect(subject.Set(ctx, "a", []byte("aa"))).NotTo(Succeed())
+		})
+
+		It("Does not keep data in memory", func() {
+			next.EXPECT().Get(gomock.Any(), "a").Return(nil, false, nil)
+			Expect(lookup(subject, "a")).To(BeEmpty())
+		})
+	})
+
+	Context("When next store fails to get", func() {
+		It("Passes the error through", func() {
+			next.EXPECT().Get(gomock.Any(), "a").Return(nil, false, errors.New("oups"))
+
+			_, found, err := subject.Get(ctx, "a")
+			Expect(err).To(MatchError("oups"))
+			Expect(found).To(BeFalse())
+		})
+	})
+
+	Context("When data is found in next store", func() {
+		BeforeEach(func() {
+			next.EXPECT().Get(gomock.Any(), "a").Return([]byte("aa"), true, nil).Times(1)
+			Expect(lookup(subject, "a")).To(Equal([]byte("aa")))
+		})
+
+		It("Serves it from memory afterwards", func() {
+			Expect(lookup(subject, "a")).To(Equal([]byte("aa")))
+
+			hits, misses, _ := subject.Stats()
+			Expect(hits).To(Equal(uint64(1)))
+			Expect(misses).To(Equal(uint64(1)))
+		})
+	})
+
+	Context("When data is bigger than the whole budget", func() {
+		BeforeEach(func() {
+			next.EXPECT().Set(gomock.Any(), "a", gomock.Any()).Return(nil)
+			Expect(subject.Set(ctx, "a", []byte("aaaaaaa"))).To(Succeed())
+		})
+
+		It("Is not kept in memory", func() {
+			next.EXPECT().Get(gomock.Any(), "a").Return([]byte("aaaaaaa"), true, nil)
+			Expect(lookup(subject, "a")).To(Equal([]byte("aaaaaaa")))
+		})
+	})
+})
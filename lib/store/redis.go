@@ -0,0 +1,71 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/Bobochka/thumbnail_service/lib/service"
+	goRedis "github.com/garyburd/redigo/redis"
+)
+
+// Redis keeps data under prefixed keys, optionally expiring after ttl.
+// Objects bigger than maxSize are not kept, since redis memory is precious,
+// service.ErrTooLarge is returned for them, so that they are not mistaken for stored ones.
+// Cancellation is checked before the call only, as redis calls are short.
+type Redis struct {
+	pool    *goRedis.Pool
+	prefix  string
+	ttl     time.Duration
+	maxSize int
+}
+
+func NewRedis(pool *goRedis.Pool, prefix string, ttl time.Duration, maxSize int) *Redis {
+	return &Redis{
+		pool:    pool,
+		prefix:  prefix,
+		ttl:     ttl,
+		maxSize: maxSize,
+	}
+}
+
+func (s *Redis) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	data, err := goRedis.Bytes(conn.Do("GET", s.prefix+key))
+	if err == goRedis.ErrNil {
+		return nil, false, nil
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return data, true, nil
+}
+
+func (s *Redis) Set(ctx context.Context, key string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if s.maxSize > 0 && len(data) > s.maxSize {
+		return service.ErrTooLarge
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	var err error
+	if s.ttl > 0 {
+		_, err = conn.Do("SET", s.prefix+key, data, "PX", int64(s.ttl/time.Millisecond))
+	} else {
+		_, err = conn.Do("SET", s.prefix+key, data)
+	}
+
+	return err
+}
@@ -0,0 +1,33 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/Bobochka/thumbnail_service/lib/service"
+	goRedis "github.com/garyburd/redigo/redis"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Redis", func() {
+	var subject *Redis
+
+	BeforeEach(func() {
+		// every call that reaches redis fails
+		pool := &goRedis.Pool{
+			Dial: func() (goRedis.Conn, error) {
+				return nil, errors.New("redis is down")
+			},
+		}
+
+		subject = NewRedis(pool, "thumbnail:", 0, 4)
+	})
+
+	It("Refuses data bigger than the limit without calling redis", func() {
+		Expect(subject.Set(ctx, "a", []byte("aaaaa"))).To(Equal(service.ErrTooLarge))
+	})
+
+	It("Fails to keep data within the limit", func() {
+		Expect(subject.Set(ctx, "a", []byte("aaaa"))).NotTo(Succeed())
+	})
+})
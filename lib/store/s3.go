@@ -2,7 +2,7 @@ package store
 
 import (
 	"bytes"
-	"log"
+	"context"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -37,7 +37,7 @@ func New(endpoint, region, bucket string) (*S3, error) {
 	}, nil
 }
 
-func (s *S3) Get(key string) []byte {
+func (s *S3) Get(ctx context.Context, key string) ([]byte, bool, error) {
 	params := &s3.GetObjectInput{
 		Bucket: s.bucket,
 		Key:    aws.String(key),
@@ -45,22 +45,22 @@ func (s *S3) Get(key string) []byte {
 
 	res := []byte{}
 	buffer := aws.NewWriteAtBuffer(res)
-	_, err := s.downloader.Download(buffer, params)
+	_, err := s.downloader.DownloadWithContext(ctx, buffer, params)
 
 	if aerr, ok := err.(awserr.Error); ok {
 		if aerr.Code() == s3.ErrCodeNoSuchKey {
-			return buffer.Bytes()
+			return nil, false, nil
 		}
 	}
 
 	if err != nil {
-		log.Printf("unable to read from s3: %+v\n", err)
+		return nil, false, err
 	}
 
-	return buffer.Bytes()
+	return buffer.Bytes(), true, nil
 }
 
-func (s *S3) Set(key string, data []byte) error {
+func (s *S3) Set(ctx context.Context, key string, data []byte) error {
 	buf := bytes.NewReader(data)
 
 	params := &s3manager.UploadInput{
@@ -69,7 +69,7 @@ func (s *S3) Set(key string, data []byte) error {
 		Body:   buf,
 	}
 
-	_, err := s.uploader.Upload(params)
+	_, err := s.uploader.UploadWithContext(ctx, params)
 
 	return err
 }
@@ -0,0 +1,33 @@
+package transform
+
+import (
+	"encoding/hex"
+	"fmt"
+	"image/color"
+)
+
+var Black = color.NRGBA{A: 0xff}
+
+// ParseColor parses hex color in RRGGBB or RRGGBBAA notation
+func ParseColor(s string) (color.NRGBA, error) {
+	if len(s) != 6 && len(s) != 8 {
+		return color.NRGBA{}, fmt.Errorf("color %s should be in RRGGBB or RRGGBBAA notation", s)
+	}
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return color.NRGBA{}, err
+	}
+
+	c := color.NRGBA{R: b[0], G: b[1], B: b[2], A: 0xff}
+	if len(b) == 4 {
+		c.A = b[3]
+	}
+
+	return c, nil
+}
+
+// FormatColor is the inverse of ParseColor, always producing RRGGBBAA notation
+func FormatColor(c color.NRGBA) string {
+	return hex.EncodeToString([]byte{c.R, c.G, c.B, c.A})
+}
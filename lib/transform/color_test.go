@@ -0,0 +1,60 @@
+package transform
+
+import (
+	"image/color"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseColor", func() {
+	var subject color.NRGBA
+	var err error
+	var s string
+
+	JustBeforeEach(func() {
+		subject, err = ParseColor(s)
+	})
+
+	Context("When RRGGBB", func() {
+		BeforeEach(func() {
+			s = "ff8000"
+		})
+
+		It("Is opaque", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(subject).To(Equal(color.NRGBA{R: 0xff, G: 0x80, B: 0x00, A: 0xff}))
+		})
+	})
+
+	Context("When RRGGBBAA", func() {
+		BeforeEach(func() {
+			s = "00000000"
+		})
+
+		It("Keeps alpha", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(subject).To(Equal(color.NRGBA{}))
+		})
+	})
+
+	Context("When not hex", func() {
+		BeforeEach(func() {
+			s = "zzzzzz"
+		})
+
+		It("Returns error", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("When wrong length", func() {
+		BeforeEach(func() {
+			s = "fff"
+		})
+
+		It("Returns error", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
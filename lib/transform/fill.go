@@ -0,0 +1,79 @@
+package transform
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"image"
+
+	"image/draw"
+
+	"github.com/nfnt/resize"
+)
+
+type Fill struct {
+	Width  int
+	Height int
+	codec  Img
+}
+
+func NewFill(width, height int, codec Img) *Fill {
+	return &Fill{
+		codec:  codec,
+		Width:  width,
+		Height: height,
+	}
+}
+
+func (t Fill) Fingerprint(data []byte) string {
+	return fmt.Sprintf("%x_%s", sha1.Sum(data), t.Params())
+}
+
+func (t Fill) Params() string {
+	return fmt.Sprintf("%v_%v_fill_%s", t.Width, t.Height, t.codec.Fingerprint())
+}
+
+func (t Fill) Perform(ctx context.Context, data []byte) ([]byte, error) {
+	return t.codec.process(ctx, data, t.perform)
+}
+
+func (t *Fill) perform(img image.Image) (image.Image, error) {
+	rect := img.Bounds()
+	origW := rect.Dx()
+	origH := rect.Dy()
+
+	if origH == t.Height && origW == t.Width {
+		return img, nil
+	}
+
+	w, h := t.coverSize(origW, origH)
+	scaled := resize.Resize(uint(w), uint(h), img, resize.Bilinear)
+
+	dst := image.NewRGBA(image.Rect(0, 0, t.Width, t.Height))
+	draw.Draw(dst, dst.Bounds(), scaled, t.findSp(scaled.Bounds()), draw.Src)
+
+	return dst, nil
+}
+
+// coverSize returns the smallest size with original aspect ratio
+// that fully covers requested width and height
+func (t Fill) coverSize(origW, origH int) (int, int) {
+	scaleW := float64(t.Width) / float64(origW)
+	scaleH := float64(t.Height) / float64(origH)
+
+	roundingDelta := 0.5
+
+	if scaleW > scaleH {
+		return t.Width, max(int(float64(origH)*scaleW+roundingDelta), t.Height)
+	}
+
+	return max(int(float64(origW)*scaleH+roundingDelta), t.Width), t.Height
+}
+
+// findSp returns starting point of the centered crop within scaled image
+func (t Fill) findSp(scaledRect image.Rectangle) image.Point {
+	ptX := max((scaledRect.Dx()-t.Width)/2, 0)
+	ptY := max((scaledRect.Dy()-t.Height)/2, 0)
+
+	return scaledRect.Min.Add(image.Pt(ptX, ptY))
+}
@@ -0,0 +1,92 @@
+package transform
+
+import (
+	"image"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fill", func() {
+	var newWidth, newHeight int
+
+	Describe("coverSize", func() {
+		var w, h int
+
+		JustBeforeEach(func() {
+			fill := Fill{Height: newHeight, Width: newWidth}
+			w, h = fill.coverSize(200, 100)
+		})
+
+		Context("When frame is wider than original", func() {
+			BeforeEach(func() {
+				newWidth = 100
+				newHeight = 25
+			})
+
+			It("Scales to frame width", func() {
+				Expect([]int{w, h}).To(Equal([]int{100, 50}))
+			})
+		})
+
+		Context("When frame is taller than original", func() {
+			BeforeEach(func() {
+				newWidth = 100
+				newHeight = 100
+			})
+
+			It("Scales to frame height", func() {
+				Expect([]int{w, h}).To(Equal([]int{200, 100}))
+			})
+		})
+
+		Context("When frame is bigger than original", func() {
+			BeforeEach(func() {
+				newWidth = 300
+				newHeight = 300
+			})
+
+			It("Scales up to cover the frame", func() {
+				Expect([]int{w, h}).To(Equal([]int{600, 300}))
+			})
+		})
+	})
+
+	Describe("findSp", func() {
+		var subject image.Point
+
+		BeforeEach(func() {
+			newWidth = 100
+			newHeight = 100
+		})
+
+		Context("When horizontal overflow", func() {
+			JustBeforeEach(func() {
+				fill := Fill{Height: newHeight, Width: newWidth}
+				subject = fill.findSp(image.Rect(0, 0, 200, 100))
+			})
+
+			It("Is horizontally shifted", func() {
+				Expect(subject).To(Equal(image.Pt(50, 0)))
+			})
+		})
+
+		Context("When vertical overflow", func() {
+			JustBeforeEach(func() {
+				fill := Fill{Height: newHeight, Width: newWidth}
+				subject = fill.findSp(image.Rect(0, 0, 100, 300))
+			})
+
+			It("Is vertically shifted", func() {
+				Expect(subject).To(Equal(image.Pt(0, 100)))
+			})
+		})
+	})
+
+	Describe("Fingerprint", func() {
+		It("Differs from LPad one", func() {
+			data := []byte("image of flower")
+			Expect(NewFill(10, 10, Img{}).Fingerprint(data)).NotTo(Equal(NewLPad(10, 10, Black, Img{}).Fingerprint(data)))
+		})
+	})
+})
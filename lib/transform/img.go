@@ -2,40 +2,171 @@ package transform
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"image"
 	_ "image/draw"
-	_ "image/gif"
+	"image/gif"
 	"image/jpeg"
-	_ "image/png"
+	"image/png"
+	"time"
+
+	"github.com/Bobochka/thumbnail_service/lib"
+	"github.com/Bobochka/thumbnail_service/lib/metrics"
+	"github.com/Bobochka/thumbnail_service/lib/webp"
+)
+
+const (
+	FormatJpeg = "jpeg"
+	FormatPng  = "png"
+	FormatGif  = "gif"
+	FormatWebp = "webp"
+	// FormatAuto keeps format of the source image
+	FormatAuto = "auto"
+)
+
+var Formats = []string{FormatJpeg, FormatPng, FormatGif, FormatWebp, FormatAuto}
+
+const (
+	DefaultQuality = 100
+	MaxQuality     = 100
 )
 
-var JpegQuality = 100
 var ErrUnknownFormat = errors.New("can't decode: unknown image format")
 
 type Img struct {
+	// Format is the output format, jpeg if empty
+	Format string
+	// Alpha forces alpha capable output format, when jpeg is requested
+	Alpha bool
+	// AlphaFormat is used instead of jpeg when Alpha is set, png if empty
+	AlphaFormat string
+	// Quality is jpeg quality in 1..100 range, DefaultQuality if zero
+	Quality int
+	// Limits are checked before decoding
+	Limits Limits
 }
 
-func (Img) Encode(img image.Image) ([]byte, error) {
+func (c Img) Fingerprint() string {
+	fp := c.format("")
+	// quality matters for lossy output only
+	if fp == FormatJpeg || fp == FormatAuto {
+		fp += fmt.Sprintf("_q%d", c.quality())
+	}
+	if c.Alpha {
+		fp += "_alpha"
+		// auto turns into alpha format only once source format is known
+		if c.format("") == FormatAuto && c.AlphaFormat != "" {
+			fp += "_" + c.AlphaFormat
+		}
+	}
+	return fp
+}
+
+// process decodes data, applies geometry to the image and encodes the result, measuring each phase.
+// Cancellation is checked in between phases, as phases themselves are not interruptible.
+func (c Img) process(ctx context.Context, data []byte, geometry func(image.Image) (image.Image, error)) ([]byte, error) {
+	start := time.Now()
+	img, format, err := c.Decode(data)
+	metrics.Since(metrics.PhaseDecode, start)
+	if err != nil {
+		return nil, decodeError(err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	start = time.Now()
+	img, err = geometry(img)
+	metrics.Since(metrics.PhaseTransform, start)
+	if err != nil {
+		return nil, lib.NewError(err, lib.TransformationFailure)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	start = time.Now()
+	imgBytes, err := c.Encode(img, format)
+	metrics.Since(metrics.PhaseEncode, start)
+	if err != nil {
+		return nil, lib.NewError(err, lib.EncodingFailure)
+	}
+
+	return imgBytes, nil
+}
+
+func (c Img) Encode(img image.Image, srcFormat string) ([]byte, error) {
 	buf := &bytes.Buffer{}
-	err := jpeg.Encode(buf, img, &jpeg.Options{Quality: JpegQuality})
+
+	var err error
+	switch c.format(srcFormat) {
+	case FormatPng:
+		err = png.Encode(buf, img)
+	case FormatGif:
+		err = gif.Encode(buf, img, nil)
+	case FormatWebp:
+		err = webp.Encode(buf, img)
+	default:
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: c.quality()})
+	}
+
 	if err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
 }
 
-func (Img) Decode(data []byte) (image.Image, error) {
-	r := bytes.NewReader(data)
+func (c Img) format(srcFormat string) string {
+	format := c.Format
+
+	if format == "" {
+		format = FormatJpeg
+	}
+
+	if format == FormatAuto && srcFormat != "" {
+		format = srcFormat
+	}
+
+	// jpeg has no alpha channel, so transparency would be flattened
+	if format == FormatJpeg && c.Alpha {
+		format = FormatPng
+		if c.AlphaFormat != "" {
+			format = c.AlphaFormat
+		}
+	}
 
-	img, format, err := image.Decode(r)
+	return format
+}
+
+func (c Img) quality() int {
+	if c.Quality == 0 {
+		return DefaultQuality
+	}
+	return c.Quality
+}
+
+func (c Img) Decode(data []byte) (image.Image, string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	if err := c.Limits.check(cfg, format, data); err != nil {
+		return nil, "", err
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
 	}
 
 	if format == "" || img == nil {
-		return nil, ErrUnknownFormat
+		return nil, "", ErrUnknownFormat
 	}
 
-	return img, nil
+	return img, format, nil
 }
@@ -0,0 +1,76 @@
+package transform
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Img", func() {
+	Describe("format", func() {
+		var codec Img
+		var srcFormat string
+		var subject string
+
+		BeforeEach(func() {
+			codec = Img{}
+			srcFormat = FormatGif
+		})
+
+		JustBeforeEach(func() {
+			subject = codec.format(srcFormat)
+		})
+
+		Context("When format is not set", func() {
+			It("Is jpeg", func() {
+				Expect(subject).To(Equal(FormatJpeg))
+			})
+		})
+
+		Context("When format is auto", func() {
+			BeforeEach(func() {
+				codec.Format = FormatAuto
+			})
+
+			It("Keeps source format", func() {
+				Expect(subject).To(Equal(FormatGif))
+			})
+		})
+
+		Context("When alpha is required", func() {
+			BeforeEach(func() {
+				codec.Alpha = true
+			})
+
+			It("Replaces jpeg with png", func() {
+				Expect(subject).To(Equal(FormatPng))
+			})
+
+			Context("When alpha format is set", func() {
+				BeforeEach(func() {
+					codec.AlphaFormat = FormatWebp
+				})
+
+				It("Replaces jpeg with it", func() {
+					Expect(subject).To(Equal(FormatWebp))
+				})
+			})
+
+			Context("When format supports alpha", func() {
+				BeforeEach(func() {
+					codec.Format = FormatWebp
+				})
+
+				It("Keeps format", func() {
+					Expect(subject).To(Equal(FormatWebp))
+				})
+			})
+		})
+	})
+
+	Describe("Fingerprint", func() {
+		It("Depends on alpha format", func() {
+			codec := Img{Alpha: true}
+			Expect(codec.Fingerprint()).NotTo(Equal(Img{Alpha: true, AlphaFormat: FormatWebp}.Fingerprint()))
+		})
+	})
+})
@@ -0,0 +1,161 @@
+package transform
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+
+	"github.com/Bobochka/thumbnail_service/lib"
+)
+
+// Limits protect from decompression bombs: small files declaring huge images.
+// They are checked against image headers before decoding, zero value means no limit
+type Limits struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int
+	MaxFrames int // gif only
+}
+
+var DefaultLimits = Limits{
+	MaxWidth:  10000,
+	MaxHeight: 10000,
+	MaxPixels: 50000000,
+	MaxFrames: 1000,
+}
+
+type LimitError struct {
+	msg string
+}
+
+func (e LimitError) Error() string {
+	return e.msg
+}
+
+func (l Limits) check(cfg image.Config, format string, data []byte) error {
+	if l.MaxWidth > 0 && cfg.Width > l.MaxWidth {
+		return LimitError{fmt.Sprintf("image width %d exceeds limit of %d", cfg.Width, l.MaxWidth)}
+	}
+
+	if l.MaxHeight > 0 && cfg.Height > l.MaxHeight {
+		return LimitError{fmt.Sprintf("image height %d exceeds limit of %d", cfg.Height, l.MaxHeight)}
+	}
+
+	if l.MaxPixels > 0 && int64(cfg.Width)*int64(cfg.Height) > int64(l.MaxPixels) {
+		return LimitError{fmt.Sprintf("image size %d x %d exceeds limit of %d pixels", cfg.Width, cfg.Height, l.MaxPixels)}
+	}
+
+	if format == FormatGif && l.MaxFrames > 0 {
+		frames, err := countGifFrames(data)
+		if err != nil {
+			return err
+		}
+
+		if frames > l.MaxFrames {
+			return LimitError{fmt.Sprintf("gif frames count %d exceeds limit of %d", frames, l.MaxFrames)}
+		}
+	}
+
+	return nil
+}
+
+var errMalformedGif = errors.New("gif: malformed data")
+
+// countGifFrames walks gif blocks skipping image data, so nothing is decoded.
+// See https://www.w3.org/Graphics/GIF/spec-gif89a.txt
+func countGifFrames(data []byte) (int, error) {
+	r := bytes.NewReader(data)
+
+	// header and logical screen descriptor
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, errMalformedGif
+	}
+
+	if err := skipColorTable(r, header[10]); err != nil {
+		return 0, err
+	}
+
+	frames := 0
+	for {
+		b, err := r.ReadByte()
+		// trailer is optional for decoder as long as there is a complete frame
+		if err == io.EOF && frames > 0 {
+			return frames, nil
+		}
+		if err != nil {
+			return 0, errMalformedGif
+		}
+
+		switch b {
+		case 0x21: // extension
+			if _, err := r.ReadByte(); err != nil {
+				return 0, errMalformedGif
+			}
+			if err := skipSubBlocks(r); err != nil {
+				return 0, err
+			}
+		case 0x2c: // image descriptor
+			frames++
+
+			desc := make([]byte, 9)
+			if _, err := io.ReadFull(r, desc); err != nil {
+				return 0, errMalformedGif
+			}
+			if err := skipColorTable(r, desc[8]); err != nil {
+				return 0, err
+			}
+			// lzw minimum code size
+			if _, err := r.ReadByte(); err != nil {
+				return 0, errMalformedGif
+			}
+			if err := skipSubBlocks(r); err != nil {
+				return 0, err
+			}
+		case 0x3b: // trailer
+			return frames, nil
+		default:
+			return 0, errMalformedGif
+		}
+	}
+}
+
+func skipColorTable(r *bytes.Reader, flags byte) error {
+	if flags&0x80 == 0 {
+		return nil
+	}
+
+	size := int64(3 * (1 << (flags&0x07 + 1)))
+	if _, err := io.CopyN(ioutil.Discard, r, size); err != nil {
+		return errMalformedGif
+	}
+	return nil
+}
+
+func skipSubBlocks(r *bytes.Reader) error {
+	for {
+		size, err := r.ReadByte()
+		if err != nil {
+			return errMalformedGif
+		}
+
+		if size == 0 {
+			return nil
+		}
+
+		if _, err := io.CopyN(ioutil.Discard, r, int64(size)); err != nil {
+			return errMalformedGif
+		}
+	}
+}
+
+// decodeError maps decoding errors to lib.Error
+func decodeError(err error) error {
+	if _, ok := err.(LimitError); ok {
+		return lib.NewError(err, lib.ImageTooLarge)
+	}
+	return lib.NewError(err, lib.UnsupportedContentType)
+}
@@ -0,0 +1,121 @@
+package transform
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+
+	"github.com/Bobochka/thumbnail_service/lib"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func gifData(frames int) []byte {
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Plan9))
+		g.Delay = append(g.Delay, 0)
+	}
+
+	buf := &bytes.Buffer{}
+	err := gif.EncodeAll(buf, g)
+	Expect(err).NotTo(HaveOccurred())
+
+	return buf.Bytes()
+}
+
+func pngData(w, h int) []byte {
+	buf := &bytes.Buffer{}
+	err := png.Encode(buf, image.NewNRGBA(image.Rect(0, 0, w, h)))
+	Expect(err).NotTo(HaveOccurred())
+
+	return buf.Bytes()
+}
+
+var _ = Describe("Limits", func() {
+	var limits Limits
+	var data []byte
+	var err error
+
+	BeforeEach(func() {
+		limits = Limits{}
+	})
+
+	JustBeforeEach(func() {
+		_, err = NewLPad(2, 2, Black, Img{Limits: limits}).Perform(context.Background(), data)
+	})
+
+	ItIsRejected := func() {
+		It("Is rejected as too large", func() {
+			Expect(err).To(BeAssignableToTypeOf(lib.Error{}))
+			Expect(err.(lib.Error).Code()).To(Equal(413))
+		})
+	}
+
+	Context("When within limits", func() {
+		BeforeEach(func() {
+			limits = Limits{MaxWidth: 4, MaxHeight: 4, MaxPixels: 16, MaxFrames: 3}
+			data = gifData(3)
+		})
+
+		It("Is performed", func() {
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Context("When too wide", func() {
+		BeforeEach(func() {
+			limits.MaxWidth = 4
+			data = pngData(5, 1)
+		})
+
+		ItIsRejected()
+	})
+
+	Context("When too tall", func() {
+		BeforeEach(func() {
+			limits.MaxHeight = 4
+			data = pngData(1, 5)
+		})
+
+		ItIsRejected()
+	})
+
+	Context("When too many pixels", func() {
+		BeforeEach(func() {
+			limits.MaxPixels = 15
+			data = pngData(4, 4)
+		})
+
+		ItIsRejected()
+	})
+
+	Context("When too many frames", func() {
+		BeforeEach(func() {
+			limits.MaxFrames = 2
+			data = gifData(3)
+		})
+
+		ItIsRejected()
+	})
+})
+
+var _ = Describe("countGifFrames", func() {
+	It("Counts frames", func() {
+		Expect(countGifFrames(gifData(5))).To(Equal(5))
+	})
+
+	It("Counts frames without trailer", func() {
+		data := gifData(3)
+		Expect(countGifFrames(data[:len(data)-1])).To(Equal(3))
+	})
+
+	It("Fails on truncated data", func() {
+		data := gifData(2)
+		_, err := countGifFrames(data[:len(data)-5])
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -1,51 +1,45 @@
 package transform
 
 import (
+	"context"
 	"crypto/sha1"
 	"fmt"
 	"image"
+	"image/color"
 
 	"image/draw"
 
-	"github.com/Bobochka/thumbnail_service/lib"
 	"github.com/nfnt/resize"
 )
 
 type LPad struct {
 	Width  int
 	Height int
+	Bg     color.NRGBA
 	codec  Img
 }
 
-func NewLPad(width, height int) *LPad {
+func NewLPad(width, height int, bg color.NRGBA, codec Img) *LPad {
+	codec.Alpha = codec.Alpha || bg.A != 0xff
+
 	return &LPad{
-		codec:  Img{},
+		codec:  codec,
 		Width:  width,
 		Height: height,
+		Bg:     bg,
 	}
 }
 
 func (t LPad) Fingerprint(data []byte) string {
-	return fmt.Sprintf("%x_%v_%v", sha1.Sum(data), t.Width, t.Height)
+	return fmt.Sprintf("%x_%s", sha1.Sum(data), t.Params())
 }
 
-func (t LPad) Perform(data []byte) ([]byte, error) {
-	img, err := t.codec.Decode(data)
-	if err != nil {
-		return nil, lib.NewError(err, lib.UnsupportedContentType)
-	}
-
-	img, err = t.perform(img)
-	if err != nil {
-		return nil, lib.NewError(err, lib.TransformationFailure)
-	}
-
-	imgBytes, err := t.codec.Encode(img)
-	if err != nil {
-		return nil, lib.NewError(err, lib.EncodingFailure)
-	}
+func (t LPad) Params() string {
+	return fmt.Sprintf("%v_%v_%s_%s", t.Width, t.Height, FormatColor(t.Bg), t.codec.Fingerprint())
+}
 
-	return imgBytes, nil
+func (t LPad) Perform(ctx context.Context, data []byte) ([]byte, error) {
+	return t.codec.process(ctx, data, t.perform)
 }
 
 func (t *LPad) perform(img image.Image) (image.Image, error) {
@@ -65,8 +59,9 @@ func (t *LPad) perform(img image.Image) (image.Image, error) {
 
 	pt := t.findSp(thumb.Bounds())
 
-	dst := image.NewRGBA(image.Rect(0, 0, t.Width, t.Height))
-	draw.Draw(dst, dst.Bounds(), thumb, pt, draw.Src)
+	dst := image.NewNRGBA(image.Rect(0, 0, t.Width, t.Height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(t.Bg), image.ZP, draw.Src)
+	draw.Draw(dst, dst.Bounds(), thumb, pt, draw.Over)
 
 	return dst, nil
 }
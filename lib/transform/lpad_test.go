@@ -1,6 +1,7 @@
 package transform
 
 import (
+	"context"
 	"testing"
 
 	"image"
@@ -107,3 +108,13 @@ var _ = Describe("isScaledDownsize", func() {
 		})
 	})
 })
+
+var _ = Describe("Perform", func() {
+	It("Stops once cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := NewLPad(2, 2, Black, Img{}).Perform(ctx, pngData(4, 4))
+		Expect(err).To(Equal(context.Canceled))
+	})
+})
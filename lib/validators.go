@@ -0,0 +1,25 @@
+package lib
+
+import "errors"
+
+var ErrSourceNotModified = errors.New("source is not modified")
+
+// Validators identify version of the resource, as reported by origin
+type Validators struct {
+	ETag         string
+	LastModified string
+}
+
+func (v Validators) Empty() bool {
+	return v.ETag == "" && v.LastModified == ""
+}
+
+// Match reports whether both validators identify the same version.
+// ETag is preferred, Last-Modified is compared only if either ETag is missing.
+func (v Validators) Match(other Validators) bool {
+	if v.ETag != "" && other.ETag != "" {
+		return v.ETag == other.ETag
+	}
+
+	return v.LastModified != "" && v.LastModified == other.LastModified
+}
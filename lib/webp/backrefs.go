@@ -0,0 +1,194 @@
+package webp
+
+import "math/bits"
+
+const (
+	hashBits  = 16
+	maxChain  = 32
+	minLength = 3
+	maxLength = 4096
+
+	// distances up to 120 are reserved for 2D neighbourhood codes
+	planeCodes  = 120
+	maxDistance = 1<<20 - planeCodes
+
+	colorCacheMultiplier = 0x1e35a7bd
+	maxCacheBits         = 10
+)
+
+// distanceMapTable maps plane codes to (y, 8-x) offsets packed into nibbles, as spec defines it
+var distanceMapTable = [planeCodes]uint8{
+	0x18, 0x07, 0x17, 0x19, 0x28, 0x06, 0x27, 0x29, 0x16, 0x1a,
+	0x26, 0x2a, 0x38, 0x05, 0x37, 0x39, 0x15, 0x1b, 0x36, 0x3a,
+	0x25, 0x2b, 0x48, 0x04, 0x47, 0x49, 0x14, 0x1c, 0x35, 0x3b,
+	0x46, 0x4a, 0x24, 0x2c, 0x58, 0x45, 0x4b, 0x34, 0x3c, 0x03,
+	0x57, 0x59, 0x13, 0x1d, 0x56, 0x5a, 0x23, 0x2d, 0x44, 0x4c,
+	0x55, 0x5b, 0x33, 0x3d, 0x68, 0x02, 0x67, 0x69, 0x12, 0x1e,
+	0x66, 0x6a, 0x22, 0x2e, 0x54, 0x5c, 0x43, 0x4d, 0x65, 0x6b,
+	0x32, 0x3e, 0x78, 0x01, 0x77, 0x79, 0x53, 0x5d, 0x11, 0x1f,
+	0x64, 0x6c, 0x42, 0x4e, 0x76, 0x7a, 0x21, 0x2f, 0x75, 0x7b,
+	0x31, 0x3f, 0x63, 0x6d, 0x52, 0x5e, 0x00, 0x74, 0x7c, 0x41,
+	0x4f, 0x10, 0x20, 0x62, 0x6e, 0x30, 0x73, 0x7d, 0x51, 0x5f,
+	0x40, 0x72, 0x7e, 0x61, 0x6f, 0x50, 0x71, 0x7f, 0x60, 0x70,
+}
+
+// ref is a literal pixel when length is zero, otherwise a copy of length pixels from distance code back
+type ref struct {
+	length uint32
+	code   uint32
+}
+
+// backwardRefs greedily replaces repeated pixel runs with copies, found via hash chains of pixel pairs.
+// Pixels of the same column in previous rows are checked first, as well as the previous pixel.
+func backwardRefs(argb []uint32, width int) []ref {
+	n := len(argb)
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, n)
+	codes := distanceCodes(width)
+
+	insert := func(i int) {
+		if i+1 < n {
+			h := pairHash(argb[i], argb[i+1])
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+
+	refs := make([]ref, 0, n)
+	for i := 0; i < n; {
+		limit := min(maxLength, n-i)
+		bestLen, bestDist := 0, 0
+
+		try := func(j int) {
+			if l := matchLength(argb, j, i, limit); l > bestLen {
+				bestLen, bestDist = l, i-j
+			}
+		}
+
+		if i >= 1 {
+			try(i - 1)
+		}
+		if i >= width {
+			try(i - width)
+		}
+
+		if i+1 < n && bestLen < limit {
+			j := head[pairHash(argb[i], argb[i+1])]
+			for chain := 0; j >= 0 && chain < maxChain && i-int(j) <= maxDistance && bestLen < limit; chain++ {
+				try(int(j))
+				j = prev[j]
+			}
+		}
+
+		if bestLen < minLength {
+			refs = append(refs, ref{})
+			insert(i)
+			i++
+			continue
+		}
+
+		refs = append(refs, ref{length: uint32(bestLen), code: distanceCode(codes, bestDist)})
+		for end := i + bestLen; i < end; i++ {
+			insert(i)
+		}
+	}
+
+	return refs
+}
+
+func matchLength(argb []uint32, from, to, limit int) int {
+	l := 0
+	for l < limit && argb[from+l] == argb[to+l] {
+		l++
+	}
+	return l
+}
+
+func pairHash(a, b uint32) uint32 {
+	return (a*colorCacheMultiplier ^ b*0x9e3779b1) >> (32 - hashBits)
+}
+
+// distanceCodes inverts distance map for given width, keeping the smallest plane code of every distance
+func distanceCodes(width int) []uint8 {
+	codes := make([]uint8, 8*width+8)
+	for c := planeCodes; c > 0; c-- {
+		v := distanceMapTable[c-1]
+		d := int(v>>4)*width + 8 - int(v&0xf)
+		if d >= 1 {
+			codes[d] = uint8(c)
+		}
+	}
+	return codes
+}
+
+func distanceCode(codes []uint8, dist int) uint32 {
+	if dist < len(codes) && codes[dist] > 0 {
+		return uint32(codes[dist])
+	}
+	return uint32(dist + planeCodes)
+}
+
+// prefixEncode splits length or distance code value into prefix symbol and extra bits
+func prefixEncode(v uint32) (symbol uint32, extraBits uint, extra uint32) {
+	d := v - 1
+	if d < 4 {
+		return d, 0, 0
+	}
+
+	h := uint(bits.Len32(d)) - 1
+	extraBits = h - 1
+	return uint32(2*h) + d>>extraBits&1, extraBits, d & (1<<extraBits - 1)
+}
+
+// symbolSink consumes image coded as literals, color cache hits and backward copies
+type symbolSink interface {
+	literal(p uint32)
+	cached(key uint32)
+	copy(length, code uint32)
+}
+
+// walk feeds refs to sink, turning literals found in the color cache into cache hits
+func walk(argb []uint32, refs []ref, cacheBits uint, sink symbolSink) {
+	var cache []uint32
+	if cacheBits > 0 {
+		cache = make([]uint32, 1<<cacheBits)
+	}
+
+	pos := 0
+	for _, r := range refs {
+		if r.length > 0 {
+			sink.copy(r.length, r.code)
+			if cache != nil {
+				for _, p := range argb[pos : pos+int(r.length)] {
+					cache[cacheKey(p, cacheBits)] = p
+				}
+			}
+			pos += int(r.length)
+			continue
+		}
+
+		p := argb[pos]
+		pos++
+
+		if cache == nil {
+			sink.literal(p)
+			continue
+		}
+
+		key := cacheKey(p, cacheBits)
+		if cache[key] == p {
+			sink.cached(key)
+			continue
+		}
+
+		cache[key] = p
+		sink.literal(p)
+	}
+}
+
+func cacheKey(p uint32, cacheBits uint) uint32 {
+	return p * colorCacheMultiplier >> (32 - cacheBits)
+}
@@ -0,0 +1,205 @@
+package webp
+
+import "math"
+
+const (
+	predictorTransform     = 0
+	subtractGreenTransform = 2
+
+	// predictor modes are picked per tile of 1<<predictorBits pixels square
+	predictorBits  = 4
+	numPredictors  = 14
+	blackPredictor = 0
+)
+
+// residualCost approximates bits spent on a residual byte, small residuals are cheap either sign
+var residualCost [256]float32
+
+func init() {
+	for v := range residualCost {
+		d := v
+		if d > 128 {
+			d = 256 - d
+		}
+		residualCost[v] = float32(math.Log2(1 + float64(d)))
+	}
+}
+
+// subtractGreen decorrelates red and blue from green, which usually carries most of luminance
+func subtractGreen(argb []uint32) {
+	for i, p := range argb {
+		g := p >> 8 & 0xff
+		r := (p>>16 - g) & 0xff
+		b := (p - g) & 0xff
+		argb[i] = p&0xff00ff00 | r<<16 | b
+	}
+}
+
+// applyPredictors picks predictor mode of each tile and replaces pixels with residuals,
+// modes are returned as sub-image with mode in green channel
+func applyPredictors(argb []uint32, width, height int) (modes []uint32, tilesW int) {
+	tilesW = subSampleSize(width, predictorBits)
+	tilesH := subSampleSize(height, predictorBits)
+	modes = make([]uint32, tilesW*tilesH)
+
+	for ty := 0; ty < tilesH; ty++ {
+		for tx := 0; tx < tilesW; tx++ {
+			modes[ty*tilesW+tx] = 0xff000000 | uint32(bestPredictor(argb, width, height, tx, ty))<<8
+		}
+	}
+
+	// walking backwards keeps neighbours of every pixel intact until it is predicted
+	for y := height - 1; y >= 0; y-- {
+		for x := width - 1; x >= 0; x-- {
+			i := y*width + x
+			mode := int(modes[(y>>predictorBits)*tilesW+x>>predictorBits] >> 8 & 0xff)
+			argb[i] = subPixels(argb[i], predictAt(argb, width, x, y, mode))
+		}
+	}
+
+	return modes, tilesW
+}
+
+func bestPredictor(argb []uint32, width, height, tx, ty int) int {
+	x0, y0 := tx<<predictorBits, ty<<predictorBits
+	x1, y1 := min(x0+1<<predictorBits, width), min(y0+1<<predictorBits, height)
+
+	// first row and column have fixed predictors
+	x0, y0 = max(x0, 1), max(y0, 1)
+
+	best, bestCost := blackPredictor, float32(math.MaxFloat32)
+	for mode := 0; mode < numPredictors; mode++ {
+		cost := float32(0)
+		for y := y0; y < y1; y++ {
+			for x := x0; x < x1; x++ {
+				i := y*width + x
+				r := subPixels(argb[i], predict(argb, i, width, mode))
+				cost += residualCost[r>>24] + residualCost[r>>16&0xff] + residualCost[r>>8&0xff] + residualCost[r&0xff]
+			}
+		}
+
+		if cost < bestCost {
+			best, bestCost = mode, cost
+		}
+	}
+
+	return best
+}
+
+func predictAt(argb []uint32, width, x, y, mode int) uint32 {
+	i := y*width + x
+
+	switch {
+	case x == 0 && y == 0:
+		return predict(argb, i, width, blackPredictor)
+	case y == 0:
+		return argb[i-1]
+	case x == 0:
+		return argb[i-width]
+	}
+
+	return predict(argb, i, width, mode)
+}
+
+// predict expects pixel i to have left and top neighbours,
+// top right neighbour of the last column is the first pixel of the current row, as spec says
+func predict(argb []uint32, i, width, mode int) uint32 {
+	if mode == blackPredictor {
+		return 0xff000000
+	}
+
+	l, t, tl, tr := argb[i-1], argb[i-width], argb[i-width-1], argb[i-width+1]
+
+	switch mode {
+	case 1:
+		return l
+	case 2:
+		return t
+	case 3:
+		return tr
+	case 4:
+		return tl
+	case 5:
+		return average2(average2(l, tr), t)
+	case 6:
+		return average2(l, tl)
+	case 7:
+		return average2(l, t)
+	case 8:
+		return average2(tl, t)
+	case 9:
+		return average2(t, tr)
+	case 10:
+		return average2(average2(l, tl), average2(t, tr))
+	case 11:
+		return selectPredictor(l, t, tl)
+	case 12:
+		return perChannel(func(l, t, tl int) int { return l + t - tl }, l, t, tl)
+	default:
+		return perChannel(func(a, tl, _ int) int { return a + (a-tl)/2 }, average2(l, t), tl, 0)
+	}
+}
+
+// average2 averages each channel, rounding down
+func average2(a, b uint32) uint32 {
+	return ((a^b)&0xfefefefe)>>1 + a&b
+}
+
+func selectPredictor(l, t, tl uint32) uint32 {
+	pl, pt := 0, 0
+	for s := uint(0); s < 32; s += 8 {
+		pl += abs(channel(tl, s) - channel(t, s))
+		pt += abs(channel(tl, s) - channel(l, s))
+	}
+
+	if pl < pt {
+		return l
+	}
+	return t
+}
+
+// perChannel applies f to each channel of a, b, c clamping results to 0..255
+func perChannel(f func(a, b, c int) int, a, b, c uint32) uint32 {
+	res := uint32(0)
+	for s := uint(0); s < 32; s += 8 {
+		v := f(channel(a, s), channel(b, s), channel(c, s))
+		res |= uint32(max(0, min(v, 0xff))) << s
+	}
+	return res
+}
+
+// subPixels subtracts each channel modulo 256
+func subPixels(a, b uint32) uint32 {
+	alphaAndGreen := 0x00ff00ff + a&0xff00ff00 - b&0xff00ff00
+	redAndBlue := 0xff00ff00 + a&0x00ff00ff - b&0x00ff00ff
+	return alphaAndGreen&0xff00ff00 | redAndBlue&0x00ff00ff
+}
+
+func channel(p uint32, shift uint) int {
+	return int(p >> shift & 0xff)
+}
+
+func subSampleSize(size int, bits uint) int {
+	return (size + 1<<bits - 1) >> bits
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,528 @@
+// Package webp implements a lossless WebP (VP8L) encoder.
+//
+// Encoder applies subtract green and predictor transforms, then codes residuals
+// with backward references and color cache, using a single set of prefix codes for the whole image.
+// Spec: https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+package webp
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"sort"
+)
+
+const (
+	maxDimension  = 1 << 14
+	maxCodeLength = 15
+	// code lengths themselves are prefix coded with codes of up to 7 bits
+	maxLengthCodeLength = 7
+
+	channelAlphabetSize  = 256
+	lengthAlphabetSize   = 24
+	distanceAlphabetSize = 40
+)
+
+var ErrTooBig = errors.New("webp: image is too big")
+
+var codeLengthCodeOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+func Encode(w io.Writer, m image.Image) error {
+	b := m.Bounds()
+	width, height := b.Dx(), b.Dy()
+
+	if width < 1 || height < 1 || width > maxDimension || height > maxDimension {
+		return ErrTooBig
+	}
+
+	argb := make([]uint32, 0, width*height)
+	hasAlpha := false
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+			hasAlpha = hasAlpha || c.A != 0xff
+			argb = append(argb, uint32(c.A)<<24|uint32(c.R)<<16|uint32(c.G)<<8|uint32(c.B))
+		}
+	}
+
+	bw := &bitWriter{}
+
+	bw.writeBits(0x2f, 8) // signature
+	bw.writeBits(uint32(width-1), 14)
+	bw.writeBits(uint32(height-1), 14)
+	bw.writeBits(boolBit(hasAlpha), 1)
+	bw.writeBits(0, 3) // version
+
+	// transforms are undone by decoder in reverse order
+	bw.writeBits(1, 1)
+	bw.writeBits(subtractGreenTransform, 2)
+	subtractGreen(argb)
+
+	bw.writeBits(1, 1)
+	bw.writeBits(predictorTransform, 2)
+	bw.writeBits(predictorBits-2, 3)
+	modes, tilesW := applyPredictors(argb, width, height)
+	writeImage(bw, modes, tilesW, false)
+
+	bw.writeBits(0, 1) // no more transforms
+
+	writeImage(bw, argb, width, true)
+
+	return writeRiff(w, bw.bytes())
+}
+
+// writeImage writes entropy coded image, the main one is also followed by transforms
+// and can have meta prefix codes, which are not used though
+func writeImage(w *bitWriter, argb []uint32, width int, main bool) {
+	refs := backwardRefs(argb, width)
+	cacheBits := bestCacheBits(argb, refs)
+
+	if cacheBits > 0 {
+		w.writeBits(1, 1)
+		w.writeBits(uint32(cacheBits), 4)
+	} else {
+		w.writeBits(0, 1)
+	}
+
+	if main {
+		w.writeBits(0, 1) // no meta prefix codes
+	}
+
+	h := newHistograms(cacheBits)
+	walk(argb, refs, cacheBits, h)
+
+	codes := &codeWriter{w: w}
+	for i, histogram := range h {
+		codes.codes[i] = newPrefixCode(histogram, maxCodeLength)
+		codes.codes[i].writeTo(w)
+	}
+
+	walk(argb, refs, cacheBits, codes)
+}
+
+// bestCacheBits picks color cache size by estimated size of coded image, zero means no cache
+func bestCacheBits(argb []uint32, refs []ref) uint {
+	best, bestCost := uint(0), math.MaxFloat64
+
+	for bits := uint(0); bits <= maxCacheBits; bits++ {
+		h := newHistograms(bits)
+		walk(argb, refs, bits, h)
+
+		if cost := h.cost(); cost < bestCost {
+			best, bestCost = bits, cost
+		}
+	}
+
+	return best
+}
+
+const (
+	green = iota
+	red
+	blue
+	alpha
+	distance
+)
+
+// histograms count symbols of green, red, blue, alpha and distance alphabets
+type histograms [5][]uint32
+
+func newHistograms(cacheBits uint) histograms {
+	cacheSize := 0
+	if cacheBits > 0 {
+		cacheSize = 1 << cacheBits
+	}
+
+	return histograms{
+		make([]uint32, channelAlphabetSize+lengthAlphabetSize+cacheSize),
+		make([]uint32, channelAlphabetSize),
+		make([]uint32, channelAlphabetSize),
+		make([]uint32, channelAlphabetSize),
+		make([]uint32, distanceAlphabetSize),
+	}
+}
+
+func (h histograms) literal(p uint32) {
+	h[green][p>>8&0xff]++
+	h[red][p>>16&0xff]++
+	h[blue][p&0xff]++
+	h[alpha][p>>24]++
+}
+
+func (h histograms) cached(key uint32) {
+	h[green][channelAlphabetSize+lengthAlphabetSize+key]++
+}
+
+func (h histograms) copy(length, code uint32) {
+	l, _, _ := prefixEncode(length)
+	h[green][channelAlphabetSize+l]++
+	d, _, _ := prefixEncode(code)
+	h[distance][d]++
+}
+
+// cost estimates coded size in bits by entropy of symbols plus rough cost of storing code lengths,
+// extra bits are the same whatever cache size is, so they are left out
+func (h histograms) cost() float64 {
+	bits := 0.0
+	for _, histogram := range h {
+		total := 0.0
+		for _, cnt := range histogram {
+			total += float64(cnt)
+		}
+
+		for _, cnt := range histogram {
+			if cnt > 0 {
+				bits += float64(cnt)*math.Log2(total/float64(cnt)) + 4
+			}
+		}
+	}
+	return bits
+}
+
+type codeWriter struct {
+	w     *bitWriter
+	codes [5]*prefixCode
+}
+
+func (c *codeWriter) literal(p uint32) {
+	c.codes[green].writeSymbol(c.w, int(p>>8&0xff))
+	c.codes[red].writeSymbol(c.w, int(p>>16&0xff))
+	c.codes[blue].writeSymbol(c.w, int(p&0xff))
+	c.codes[alpha].writeSymbol(c.w, int(p>>24))
+}
+
+func (c *codeWriter) cached(key uint32) {
+	c.codes[green].writeSymbol(c.w, channelAlphabetSize+lengthAlphabetSize+int(key))
+}
+
+func (c *codeWriter) copy(length, code uint32) {
+	l, n, extra := prefixEncode(length)
+	c.codes[green].writeSymbol(c.w, channelAlphabetSize+int(l))
+	c.w.writeBits(extra, n)
+
+	d, n, extra := prefixEncode(code)
+	c.codes[distance].writeSymbol(c.w, int(d))
+	c.w.writeBits(extra, n)
+}
+
+func writeRiff(w io.Writer, data []byte) error {
+	pad := len(data) % 2
+
+	header := make([]byte, 20)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(4+8+len(data)+pad))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	if pad > 0 {
+		data = append(data, 0)
+	}
+
+	_, err := w.Write(data)
+	return err
+}
+
+type bitWriter struct {
+	buf []byte
+	acc uint64
+	n   uint
+}
+
+// writeBits writes n least significant bits of v, least significant bit first
+func (w *bitWriter) writeBits(v uint32, n uint) {
+	w.acc |= uint64(v) << w.n
+	w.n += n
+
+	for w.n >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.n -= 8
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	if w.n > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.n = 0, 0
+	}
+
+	return w.buf
+}
+
+type prefixCode struct {
+	lengths []uint8
+	codes   []uint32
+	// simple codes list their symbols explicitly, which is possible for up to two symbols below 256
+	simple []int
+	// code of a single symbol takes no bits at all
+	silent bool
+}
+
+func newPrefixCode(histogram []uint32, maxLen uint8) *prefixCode {
+	var used []int
+	for s, cnt := range histogram {
+		if cnt > 0 {
+			used = append(used, s)
+		}
+	}
+
+	c := &prefixCode{lengths: make([]uint8, len(histogram))}
+
+	switch len(used) {
+	case 0:
+		c.simple, c.silent = []int{0}, true
+		return c
+	case 1:
+		// single symbol still needs some code length to be written, though it takes no bits
+		c.lengths[used[0]] = 1
+		c.silent = true
+	default:
+		c.lengths = codeLengths(histogram, maxLen)
+	}
+
+	if len(used) <= 2 && used[len(used)-1] < 256 {
+		c.simple = used
+	}
+
+	c.codes = canonicalCodes(c.lengths)
+
+	return c
+}
+
+func (c *prefixCode) writeTo(w *bitWriter) {
+	if c.simple != nil {
+		w.writeBits(1, 1) // simple code
+		w.writeBits(uint32(len(c.simple)-1), 1)
+		if c.simple[0] < 2 {
+			w.writeBits(0, 1)
+			w.writeBits(uint32(c.simple[0]), 1)
+		} else {
+			w.writeBits(1, 1)
+			w.writeBits(uint32(c.simple[0]), 8)
+		}
+		if len(c.simple) > 1 {
+			w.writeBits(uint32(c.simple[1]), 8)
+		}
+		return
+	}
+
+	w.writeBits(0, 1)
+
+	tokens := lengthTokens(c.lengths)
+
+	histogram := make([]uint32, len(codeLengthCodeOrder))
+	for _, t := range tokens {
+		histogram[t.symbol]++
+	}
+
+	lengthCode := newPrefixCode(histogram, maxLengthCodeLength)
+
+	n := len(codeLengthCodeOrder)
+	for n > 4 && lengthCode.lengths[codeLengthCodeOrder[n-1]] == 0 {
+		n--
+	}
+
+	w.writeBits(uint32(n-4), 4)
+	for _, s := range codeLengthCodeOrder[:n] {
+		w.writeBits(uint32(lengthCode.lengths[s]), 3)
+	}
+
+	w.writeBits(0, 1) // code lengths for the whole alphabet follow
+
+	for _, t := range tokens {
+		lengthCode.writeSymbol(w, t.symbol)
+		w.writeBits(t.extra, t.extraBits)
+	}
+}
+
+func (c *prefixCode) writeSymbol(w *bitWriter, s int) {
+	if c.silent {
+		return
+	}
+
+	l := uint(c.lengths[s])
+	w.writeBits(reverse(c.codes[s], l), l)
+}
+
+// lengthToken is either a code length, or repeat code with its extra bits
+type lengthToken struct {
+	symbol    int
+	extra     uint32
+	extraBits uint
+}
+
+// lengthTokens run length codes code lengths: 16 repeats previous length 3..6 times,
+// 17 and 18 repeat zero 3..10 and 11..138 times respectively
+func lengthTokens(lengths []uint8) []lengthToken {
+	var tokens []lengthToken
+
+	for i := 0; i < len(lengths); {
+		l := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == l {
+			run++
+		}
+		i += run
+
+		if l == 0 {
+			for run >= 11 {
+				r := min(run, 138)
+				tokens = append(tokens, lengthToken{symbol: 18, extra: uint32(r - 11), extraBits: 7})
+				run -= r
+			}
+			if run >= 3 {
+				tokens = append(tokens, lengthToken{symbol: 17, extra: uint32(run - 3), extraBits: 3})
+				run = 0
+			}
+			for ; run > 0; run-- {
+				tokens = append(tokens, lengthToken{symbol: 0})
+			}
+			continue
+		}
+
+		tokens = append(tokens, lengthToken{symbol: int(l)})
+		run--
+		for run >= 3 {
+			r := min(run, 6)
+			tokens = append(tokens, lengthToken{symbol: 16, extra: uint32(r - 3), extraBits: 2})
+			run -= r
+		}
+		for ; run > 0; run-- {
+			tokens = append(tokens, lengthToken{symbol: int(l)})
+		}
+	}
+
+	return tokens
+}
+
+// codeLengths builds huffman code lengths not exceeding maxLen.
+// Whenever tree is too deep, counts are flattened and tree is rebuilt.
+func codeLengths(histogram []uint32, maxLen uint8) []uint8 {
+	counts := make([]uint32, len(histogram))
+	copy(counts, histogram)
+
+	for {
+		lengths := huffmanLengths(counts)
+
+		ok := true
+		for _, l := range lengths {
+			if l > maxLen {
+				ok = false
+				break
+			}
+		}
+
+		if ok {
+			return lengths
+		}
+
+		for i, cnt := range counts {
+			if cnt > 0 {
+				counts[i] = (cnt + 1) / 2
+			}
+		}
+	}
+}
+
+type node struct {
+	count       uint32
+	symbol      int
+	left, right int
+}
+
+// huffmanLengths expects at least two non zero counts
+func huffmanLengths(counts []uint32) []uint8 {
+	var leaves []node
+	for s, cnt := range counts {
+		if cnt > 0 {
+			leaves = append(leaves, node{count: cnt, symbol: s, left: -1, right: -1})
+		}
+	}
+
+	sort.SliceStable(leaves, func(i, j int) bool { return leaves[i].count < leaves[j].count })
+
+	nodes := append([]node{}, leaves...)
+	internal := []int{}
+	li, ii := 0, 0
+
+	pick := func() int {
+		if ii >= len(internal) || (li < len(leaves) && leaves[li].count <= nodes[internal[ii]].count) {
+			li++
+			return li - 1
+		}
+		ii++
+		return internal[ii-1]
+	}
+
+	for n := len(leaves); n > 1; n-- {
+		a, b := pick(), pick()
+		nodes = append(nodes, node{count: nodes[a].count + nodes[b].count, symbol: -1, left: a, right: b})
+		internal = append(internal, len(nodes)-1)
+	}
+
+	depth := make([]uint8, len(nodes))
+	lengths := make([]uint8, len(counts))
+
+	// parents are always created after their children, so walking backwards visits parents first
+	for i := len(nodes) - 1; i >= 0; i-- {
+		n := nodes[i]
+		if n.symbol >= 0 {
+			lengths[n.symbol] = depth[i]
+			continue
+		}
+		depth[n.left] = depth[i] + 1
+		depth[n.right] = depth[i] + 1
+	}
+
+	return lengths
+}
+
+func canonicalCodes(lengths []uint8) []uint32 {
+	var count [maxCodeLength + 1]uint32
+	for _, l := range lengths {
+		if l > 0 {
+			count[l]++
+		}
+	}
+
+	var next [maxCodeLength + 1]uint32
+	code := uint32(0)
+	for l := 1; l <= maxCodeLength; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+
+	codes := make([]uint32, len(lengths))
+	for s, l := range lengths {
+		if l > 0 {
+			codes[s] = next[l]
+			next[l]++
+		}
+	}
+
+	return codes
+}
+
+func reverse(v uint32, n uint) uint32 {
+	r := uint32(0)
+	for i := uint(0); i < n; i++ {
+		r = r<<1 | v&1
+		v >>= 1
+	}
+	return r
+}
+
+func boolBit(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
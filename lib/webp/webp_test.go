@@ -0,0 +1,190 @@
+package webp
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"os"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/image/webp"
+)
+
+func Test(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "WebP Suite")
+}
+
+var _ = Describe("Encode", func() {
+	var src *image.NRGBA
+	var decoded image.Image
+	var encoded []byte
+	var err error
+
+	JustBeforeEach(func() {
+		buf := &bytes.Buffer{}
+		err = Encode(buf, src)
+		Expect(err).NotTo(HaveOccurred())
+		encoded = buf.Bytes()
+
+		decoded, err = webp.Decode(bytes.NewReader(encoded))
+	})
+
+	ItRoundTrips := func() {
+		It("Decodes to the same image", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decoded.Bounds()).To(Equal(src.Bounds()))
+
+			b := src.Bounds()
+			var got, expected []color.Color
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					got = append(got, color.NRGBAModel.Convert(decoded.At(x, y)))
+					expected = append(expected, src.At(x, y))
+				}
+			}
+			Expect(got).To(Equal(expected))
+		})
+	}
+
+	Context("When image is of single color", func() {
+		BeforeEach(func() {
+			src = image.NewNRGBA(image.Rect(0, 0, 3, 5))
+			for i := range src.Pix {
+				src.Pix[i] = 0x80
+			}
+		})
+
+		ItRoundTrips()
+	})
+
+	Context("When image is noisy and translucent", func() {
+		BeforeEach(func() {
+			src = image.NewNRGBA(image.Rect(0, 0, 64, 33))
+			rand.New(rand.NewSource(42)).Read(src.Pix)
+		})
+
+		ItRoundTrips()
+	})
+
+	Context("When color distribution is skewed", func() {
+		BeforeEach(func() {
+			src = image.NewNRGBA(image.Rect(0, 0, 200, 100))
+			r := rand.New(rand.NewSource(42))
+			for i := range src.Pix {
+				// exponentially distributed values produce deep huffman trees
+				src.Pix[i] = uint8(r.ExpFloat64() * 4)
+			}
+		})
+
+		ItRoundTrips()
+	})
+
+	Context("When image is a photo", func() {
+		BeforeEach(func() {
+			f, err := os.Open("../../testdata/sample.jpg")
+			Expect(err).NotTo(HaveOccurred())
+			defer f.Close()
+
+			photo, err := jpeg.Decode(f)
+			Expect(err).NotTo(HaveOccurred())
+
+			src = image.NewNRGBA(photo.Bounds())
+			draw.Draw(src, src.Bounds(), photo, photo.Bounds().Min, draw.Src)
+		})
+
+		ItRoundTrips()
+
+		It("Is smaller than png", func() {
+			buf := &bytes.Buffer{}
+			Expect(png.Encode(buf, src)).To(Succeed())
+
+			Expect(len(encoded)).To(BeNumerically("<", buf.Len()))
+		})
+	})
+
+	Context("When image repeats a pattern", func() {
+		BeforeEach(func() {
+			pattern := make([]byte, 4*7)
+			rand.New(rand.NewSource(42)).Read(pattern)
+
+			src = image.NewNRGBA(image.Rect(0, 0, 50, 40))
+			for i := range src.Pix {
+				src.Pix[i] = pattern[i%len(pattern)]
+			}
+		})
+
+		ItRoundTrips()
+
+		It("Is coded with backward references", func() {
+			Expect(len(encoded)).To(BeNumerically("<", len(src.Pix)/10))
+		})
+	})
+
+	Context("When image is a single column", func() {
+		BeforeEach(func() {
+			src = image.NewNRGBA(image.Rect(0, 0, 1, 300))
+			r := rand.New(rand.NewSource(42))
+			for i := range src.Pix {
+				src.Pix[i] = uint8(r.Intn(3))
+			}
+		})
+
+		ItRoundTrips()
+	})
+
+	Context("When image is too big", func() {
+		It("Returns error", func() {
+			err := Encode(&bytes.Buffer{}, image.NewNRGBA(image.Rect(0, 0, maxDimension+1, 1)))
+			Expect(err).To(Equal(ErrTooBig))
+		})
+	})
+})
+
+var _ = Describe("prefixEncode", func() {
+	It("Is reversed by decoder", func() {
+		for v := uint32(1); v <= 1<<20; v++ {
+			symbol, extraBits, extra := prefixEncode(v)
+
+			// as in spec
+			decoded := symbol + 1
+			if symbol >= 4 {
+				n := (symbol - 2) >> 1
+				Expect(extraBits).To(Equal(uint(n)))
+				decoded = (2+symbol&1)<<n + extra + 1
+			}
+
+			if decoded != v {
+				Fail(fmt.Sprintf("%d decodes to %d", v, decoded))
+			}
+		}
+	})
+})
+
+var _ = Describe("codeLengths", func() {
+	It("Limits code length", func() {
+		// fibonacci distributed counts build the deepest possible huffman tree
+		counts := []uint32{1, 1}
+		for len(counts) < 30 {
+			counts = append(counts, counts[len(counts)-1]+counts[len(counts)-2])
+		}
+
+		Expect(huffmanLengths(counts)).To(ContainElement(BeNumerically(">", maxCodeLength)))
+
+		lengths := codeLengths(counts, maxCodeLength)
+
+		kraft := 0.0
+		for _, l := range lengths {
+			Expect(l).To(BeNumerically("<=", maxCodeLength))
+			kraft += 1 / float64(uint(1)<<l)
+		}
+		Expect(kraft).To(Equal(1.0))
+	})
+})
@@ -1,23 +1,75 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"net/http"
 
+	"github.com/Bobochka/thumbnail_service/lib/metrics"
 	"github.com/Bobochka/thumbnail_service/lib/service"
 )
 
 func main() {
-	cfg, err := ReadConfig()
+	cfg, closeConfig, err := ReadConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	svc := service.New(cfg)
-	app := &App{service: svc}
+	app := &App{
+		service:        svc,
+		defaultQuality: jpegQuality(),
+		maxQuality:     maxJpegQuality(),
+		cacheMaxAge:    cacheMaxAge(),
+		secret:         signatureSecret(),
+		limits:         sourceLimits(),
+		requestTimeout: requestTimeout(),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/thumbnail", instrumented(app.thumbnail))
+	mux.Handle("/metrics", metrics.Handler())
+
+	srv := &http.Server{Addr: bindPort(), Handler: mux}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
-	http.HandleFunc("/thumbnail", app.thumbnail)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
 
-	log.Fatal(http.ListenAndServe(bindPort(), nil))
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case sig := <-stop:
+		log.Printf("%s received, shutting down\n", sig)
+	}
+
+	shutdown(srv, svc, closeConfig, shutdownTimeout())
+}
+
+// shutdown stops accepting requests and lets in-flight ones finish within timeout,
+// the rest are cancelled so that their mutexes are released. Connections are closed last.
+func shutdown(srv *http.Server, svc *service.Service, closeConfig func() error, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("error shutting down http server: ", err)
+	}
+
+	if err := svc.Shutdown(ctx); err != nil {
+		log.Println("error draining in-flight work: ", err)
+	}
+
+	if err := closeConfig(); err != nil {
+		log.Println("error closing connections: ", err)
+	}
 }